@@ -0,0 +1,212 @@
+// Package client runs commands through rexecd and manages its jobs and port
+// forwardings, the daemon must already be running. File copies are not
+// covered, rexec cp speaks the protocol itself.
+package client
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/brian14708/rexec/internal/protocol"
+	"github.com/brian14708/rexec/internal/sandbox"
+	"github.com/pkg/errors"
+)
+
+// AutoServer selects the least loaded server matching ExecOptions.Labels.
+const AutoServer = protocol.AutoServer
+
+// Error categories of ExitStatus
+const (
+	ErrorConnect    = protocol.ErrorConnect
+	ErrorMount      = protocol.ErrorMount
+	ErrorSpawn      = protocol.ErrorSpawn
+	ErrorRemoteExit = protocol.ErrorRemoteExit
+)
+
+type (
+	ExitStatus   = protocol.ExitStatus
+	JobInfo      = protocol.JobInfo
+	StatusReport = protocol.StatusReport
+	// ServerConnected tells which server runs a command, see
+	// Session.Connected
+	ServerConnected = protocol.ServerConnected
+	RemoteForward   = protocol.RemoteForward
+	Limits          = sandbox.Limits
+)
+
+// Client talks to the daemon listening on a unix socket. The daemon handles
+// a single request per connection, every call opens a new one.
+type Client struct {
+	// opens a connection to the daemon
+	connect func() (*protocol.Conn, error)
+
+	mu sync.Mutex
+	// connected by Dial, used by the first request
+	conn *protocol.Conn
+}
+
+// Dial connects to the daemon listening on socketPath.
+func Dial(socketPath string) (*Client, error) {
+	conn, err := protocol.Dial(socketPath)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		connect: func() (*protocol.Conn, error) {
+			return protocol.Dial(socketPath)
+		},
+		conn: conn,
+	}, nil
+}
+
+func (c *Client) dial() (*protocol.Conn, error) {
+	c.mu.Lock()
+	conn := c.conn
+	c.conn = nil
+	c.mu.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+	return c.connect()
+}
+
+// Close releases the idle connection, running sessions are not affected.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	conn := c.conn
+	c.conn = nil
+	c.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	return conn.Close()
+}
+
+type ExecOptions struct {
+	// empty uses the default server, AutoServer the least loaded one
+	// matching Labels
+	Server string
+	Labels map[string]string
+	// name of a profile in the daemon config
+	Profile string
+	// keep the command running without a client, the session only reports
+	// the job
+	Detach bool
+
+	Command string
+	Args    []string
+	// defaults to the current directory
+	WorkingDir string
+	// forwarded according to the daemon's policy, defaults to os.Environ()
+	Env []string
+	// set regardless of the policy
+	ExtraEnv []string
+
+	// nil runs the command without a PTY
+	Terminal *Terminal
+
+	RemoteForward []RemoteForward
+	// dials the local side of RemoteForward connections, only their Connect
+	// addresses are dialed, defaults to net.Dial
+	DialForward func(network, address string) (net.Conn, error)
+
+	// zero uses the server default
+	Timeout     time.Duration
+	IdleTimeout time.Duration
+	// can only tighten the configured limits
+	Limits Limits
+
+	// run in a copy of the working directory, nil uses the server default
+	Sync        *bool
+	SyncOutputs []string
+}
+
+type Terminal struct {
+	// TERM of the remote command
+	Name  string
+	Cols  int
+	Lines int
+}
+
+func (o *ExecOptions) request() (*protocol.ExecRequest, error) {
+	req := &protocol.ExecRequest{
+		Server:     o.Server,
+		Labels:     o.Labels,
+		Detach:     o.Detach,
+		Profile:    o.Profile,
+		Command:    o.Command,
+		Args:       o.Args,
+		WorkingDir: o.WorkingDir,
+		Env:        o.Env,
+		ExtraEnv:   o.ExtraEnv,
+		DisablePTY: o.Terminal == nil,
+
+		RemoteForward: o.RemoteForward,
+
+		Timeout:     o.Timeout,
+		IdleTimeout: o.IdleTimeout,
+		Limits:      o.Limits,
+
+		Sync:        o.Sync,
+		SyncOutputs: o.SyncOutputs,
+	}
+	if t := o.Terminal; t != nil {
+		req.TerminalName = t.Name
+		req.TerminalCols = t.Cols
+		req.TerminalLines = t.Lines
+	}
+	if req.WorkingDir == "" {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot get current working directory")
+		}
+		req.WorkingDir = cwd
+	}
+	if req.Env == nil {
+		req.Env = os.Environ()
+	}
+	return req, nil
+}
+
+// Exec starts a command and returns once it is running. A command that could
+// not be started is reported by Wait with the category of the failure. If ctx
+// is done before the command exits it is killed.
+func (c *Client) Exec(ctx context.Context, opts ExecOptions) (*Session, error) {
+	req, err := opts.request()
+	if err != nil {
+		return nil, err
+	}
+	if opts.Detach && len(opts.RemoteForward) > 0 {
+		return nil, errors.New("remote forwarding cannot be used with Detach")
+	}
+
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	if len(opts.RemoteForward) > 0 {
+		dial := opts.DialForward
+		if dial == nil {
+			dial = net.Dial
+		}
+		go serveRemoteForwards(conn, opts.RemoteForward, dial)
+	}
+	return start(ctx, conn, &protocol.Request{Exec: req}, !opts.Detach)
+}
+
+// Attach connects to a running job, the latest one without clients if id is
+// empty. Closing the session leaves the job running.
+func (c *Client) Attach(ctx context.Context, id string) (*Session, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	return start(ctx, conn, &protocol.Request{
+		Attach: &protocol.AttachRequest{
+			ID: id,
+		},
+	}, true)
+}
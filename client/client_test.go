@@ -0,0 +1,223 @@
+package client
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/brian14708/rexec/internal/protocol"
+	"github.com/xtaci/smux"
+)
+
+// handler serves a request like rexecd, the connection is closed when it
+// returns.
+type handler func(sess *smux.Session, cmd *protocol.CommandChan, req *protocol.Request)
+
+// fakeDaemon returns a client whose connections are served in-process by h.
+func fakeDaemon(t *testing.T, h handler) *Client {
+	return &Client{
+		connect: func() (*protocol.Conn, error) {
+			a, b := net.Pipe()
+			go func() {
+				defer b.Close()
+				sess, err := smux.Server(b, nil)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer sess.Close()
+				stream, err := sess.AcceptStream()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				cmd := protocol.NewCommandChan(stream)
+				defer cmd.Close()
+				req, err := cmd.RecvRequest()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				h(sess, cmd, req)
+			}()
+			return protocol.NewConn(a)
+		},
+	}
+}
+
+// startJob reports the server and a job and accepts its stdio streams like
+// handleExec.
+func startJob(sess *smux.Session, cmd *protocol.CommandChan) (in, out, errOut *smux.Stream) {
+	cmd.SendNotification(&protocol.Notification{
+		Connected: &protocol.ServerConnected{Server: "build1", Latency: time.Second},
+	})
+	cmd.SendNotification(&protocol.Notification{
+		Job: &protocol.JobInfo{ID: "1", Command: "cat"},
+	})
+	in, _ = sess.AcceptStream()
+	out, _ = sess.AcceptStream()
+	errOut, _ = sess.AcceptStream()
+	return in, out, errOut
+}
+
+func TestExecStdinEOF(t *testing.T) {
+	c := fakeDaemon(t, func(sess *smux.Session, cmd *protocol.CommandChan, req *protocol.Request) {
+		in, out, errOut := startJob(sess, cmd)
+		// cat, the exit status is only sent after stdin ended
+		io.Copy(out, in)
+		out.Close()
+		errOut.Close()
+		cmd.SendNotification(&protocol.Notification{
+			Exit: &protocol.ExitStatus{ExitCode: 3, Category: protocol.ErrorRemoteExit},
+		})
+	})
+
+	s, err := c.Exec(context.Background(), ExecOptions{Command: "cat"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv := s.Connected(); srv == nil || srv.Server != "build1" || srv.Latency != time.Second {
+		t.Fatalf("Connected = %+v", srv)
+	}
+	if j := s.Job(); j == nil || j.ID != "1" {
+		t.Fatalf("Job = %+v", j)
+	}
+	if _, err := io.WriteString(s.Stdin, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	s.Stdin.Close()
+	b, err := ioutil.ReadAll(s.Stdout)
+	if err != nil || string(b) != "hello" {
+		t.Fatalf("stdout = %q, %v", b, err)
+	}
+	st, err := s.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.ExitCode != 3 || st.Category != ErrorRemoteExit {
+		t.Errorf("exit status = %+v", st)
+	}
+}
+
+func TestExecNotifications(t *testing.T) {
+	tests := []struct {
+		name string
+		send func(*Session) error
+		want protocol.Notification
+	}{
+		{"signal", func(s *Session) error { return s.Signal("INT") }, protocol.Notification{Signal: &protocol.Signal{Name: "INT"}}},
+		{"resize", func(s *Session) error { return s.Resize(120, 40) }, protocol.Notification{WindowChange: &protocol.WindowChange{TerminalCols: 120, TerminalLines: 40}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make(chan *protocol.Notification, 1)
+			c := fakeDaemon(t, func(sess *smux.Session, cmd *protocol.CommandChan, req *protocol.Request) {
+				_, out, errOut := startJob(sess, cmd)
+				n := <-cmd.RecvNotification()
+				got <- n
+				out.Close()
+				errOut.Close()
+				exit := &protocol.ExitStatus{Category: protocol.ErrorRemoteExit}
+				if n != nil && n.Signal != nil {
+					exit.ExitCode, exit.Signal = 130, n.Signal.Name
+				}
+				cmd.SendNotification(&protocol.Notification{Exit: exit})
+			})
+
+			s, err := c.Exec(context.Background(), ExecOptions{Command: "sleep"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.send(s); err != nil {
+				t.Fatal(err)
+			}
+			var n *protocol.Notification
+			select {
+			case n = <-got:
+			case <-time.After(5 * time.Second):
+				t.Fatal("daemon did not receive a notification")
+			}
+			switch {
+			case n == nil:
+				t.Fatal("notifications closed")
+			case tt.want.Signal != nil && (n.Signal == nil || *n.Signal != *tt.want.Signal):
+				t.Errorf("signal = %+v, want %+v", n.Signal, tt.want.Signal)
+			case tt.want.WindowChange != nil && (n.WindowChange == nil || *n.WindowChange != *tt.want.WindowChange):
+				t.Errorf("window change = %+v, want %+v", n.WindowChange, tt.want.WindowChange)
+			}
+
+			st, err := s.Wait()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want.Signal != nil && (st.Signal != "INT" || st.ExitCode != 130) {
+				t.Errorf("exit status = %+v", st)
+			}
+		})
+	}
+}
+
+func TestExecSpawnFailure(t *testing.T) {
+	c := fakeDaemon(t, func(sess *smux.Session, cmd *protocol.CommandChan, req *protocol.Request) {
+		cmd.SendNotification(&protocol.Notification{
+			Exit: &protocol.ExitStatus{ExitCode: 255, Error: "unknown server: x", Category: protocol.ErrorConnect},
+		})
+	})
+
+	s, err := c.Exec(context.Background(), ExecOptions{Server: "x", Command: "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Connected() != nil || s.Job() != nil {
+		t.Errorf("Connected = %+v, Job = %+v, want nil", s.Connected(), s.Job())
+	}
+	st, err := s.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.ExitCode != 255 || st.Category != ErrorConnect {
+		t.Errorf("exit status = %+v", st)
+	}
+}
+
+func TestRequests(t *testing.T) {
+	c := fakeDaemon(t, func(sess *smux.Session, cmd *protocol.CommandChan, req *protocol.Request) {
+		switch {
+		case req.Status != nil:
+			cmd.SendNotification(&protocol.Notification{
+				Status: &protocol.StatusReport{Servers: []protocol.ServerStatus{{Name: "a"}}},
+			})
+		case req.Jobs != nil:
+			cmd.SendNotification(&protocol.Notification{
+				Jobs: []protocol.JobInfo{{ID: "1"}, {ID: "2"}},
+			})
+		case req.Kill != nil && req.Kill.ID != "1":
+			cmd.SendNotification(&protocol.Notification{
+				Error: &protocol.Error{Message: "unknown job: " + req.Kill.ID},
+			})
+		case req.Kill != nil && req.Kill.Signal != "INT":
+			cmd.SendNotification(&protocol.Notification{
+				Error: &protocol.Error{Message: "unexpected signal " + req.Kill.Signal},
+			})
+		}
+	})
+	ctx := context.Background()
+
+	st, err := c.Status(ctx)
+	if err != nil || len(st.Servers) != 1 || st.Servers[0].Name != "a" {
+		t.Errorf("Status = %+v, %v", st, err)
+	}
+	jobs, err := c.Jobs(ctx)
+	if err != nil || len(jobs) != 2 {
+		t.Errorf("Jobs = %+v, %v", jobs, err)
+	}
+	if err := c.Kill(ctx, "1", "INT"); err != nil {
+		t.Errorf("Kill = %v", err)
+	}
+	if err := c.Kill(ctx, "2", "INT"); err == nil || err.Error() != "unknown job: 2" {
+		t.Errorf("Kill of unknown job = %v", err)
+	}
+}
@@ -0,0 +1,124 @@
+package client
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	"github.com/brian14708/rexec/internal/forward"
+	"github.com/brian14708/rexec/internal/protocol"
+	"github.com/pkg/errors"
+)
+
+// serveRemoteForwards dials the local side of connections the daemon
+// accepted on a remote listener, only addresses of fwds are dialed.
+func serveRemoteForwards(conn *protocol.Conn, fwds []RemoteForward, dial func(network, address string) (net.Conn, error)) {
+	allowed := make(map[string]bool)
+	for _, f := range fwds {
+		allowed[f.Connect] = true
+	}
+	for {
+		stream, err := conn.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			sc := protocol.NewCommandChan(stream)
+			req, err := sc.RecvRequest()
+			if err != nil || req.Dial == nil || !allowed[req.Dial.Address] {
+				sc.Close()
+				return
+			}
+			c, err := dial(req.Dial.Network, req.Dial.Address)
+			if err != nil {
+				sc.Close()
+				return
+			}
+			forward.Pipe(c, sc)
+		}()
+	}
+}
+
+// Forwarder tunnels connections through the SSH connection of a server.
+type Forwarder struct {
+	conn *protocol.Conn
+	// closed once the daemon ended the forwarding session
+	done chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+// Forward starts a port forwarding session to a server, which is resolved
+// like for Exec, AutoServer is not supported.
+func (c *Client) Forward(server, profile string) (*Forwarder, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	notifications, err := conn.Request(&protocol.Request{
+		Forward: &protocol.ForwardRequest{
+			Server:  server,
+			Profile: profile,
+		},
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	f := &Forwarder{
+		conn: conn,
+		done: make(chan struct{}),
+	}
+	go func() {
+		for n := range notifications {
+			if n.Error != nil {
+				f.mu.Lock()
+				f.err = errors.New(n.Error.Message)
+				f.mu.Unlock()
+			}
+		}
+		close(f.done)
+	}()
+	return f, nil
+}
+
+// Dial connects to address as seen from the server.
+func (f *Forwarder) Dial(network, address string) (io.ReadWriteCloser, error) {
+	stream, err := f.conn.OpenStream()
+	if err != nil {
+		if ferr := f.Err(); ferr != nil {
+			return nil, ferr
+		}
+		return nil, err
+	}
+	sc := protocol.NewCommandChan(stream)
+	err = sc.SendRequest(&protocol.Request{
+		Dial: &protocol.DialRequest{
+			Network: network,
+			Address: address,
+		},
+	})
+	if err != nil {
+		sc.Close()
+		return nil, err
+	}
+	return sc, nil
+}
+
+// Done is closed once the daemon ended the session, e.g. since the server
+// is unknown, Err tells why.
+func (f *Forwarder) Done() <-chan struct{} {
+	return f.done
+}
+
+// Err returns the error the daemon ended the session with.
+func (f *Forwarder) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+func (f *Forwarder) Close() error {
+	return f.conn.Close()
+}
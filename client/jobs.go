@@ -0,0 +1,149 @@
+package client
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/brian14708/rexec/internal/protocol"
+	"github.com/pkg/errors"
+)
+
+// call sends req and returns the first notification reply accepts, errors
+// reported by the daemon are returned. With a nil reply it waits until the
+// daemon is done with the request.
+func (c *Client) call(ctx context.Context, req *protocol.Request, reply func(*protocol.Notification) bool) (*protocol.Notification, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	notifications, err := conn.Request(req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	defer func() {
+		conn.Close()
+		go func() {
+			for range notifications {
+			}
+		}()
+	}()
+
+	for {
+		select {
+		case n, ok := <-notifications:
+			switch {
+			case !ok && reply == nil:
+				return nil, nil
+			case !ok:
+				return nil, errors.New("daemon closed connection")
+			case n.Error != nil:
+				return nil, errors.New(n.Error.Message)
+			case reply != nil && reply(n):
+				return n, nil
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Status describes the daemon, its servers and running jobs.
+func (c *Client) Status(ctx context.Context) (*StatusReport, error) {
+	n, err := c.call(ctx, &protocol.Request{
+		Status: &protocol.StatusRequest{},
+	}, func(n *protocol.Notification) bool {
+		return n.Status != nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return n.Status, nil
+}
+
+// Jobs lists the running jobs and the finished ones whose exit status was
+// not collected yet.
+func (c *Client) Jobs(ctx context.Context) ([]JobInfo, error) {
+	n, err := c.call(ctx, &protocol.Request{
+		Jobs: &protocol.JobsRequest{},
+	}, func(n *protocol.Notification) bool {
+		return n.Jobs != nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return n.Jobs, nil
+}
+
+// Kill sends a signal to a job, "TERM" if sig is empty. Killing a finished
+// job forgets it.
+func (c *Client) Kill(ctx context.Context, id, sig string) error {
+	_, err := c.call(ctx, &protocol.Request{
+		Kill: &protocol.KillRequest{
+			ID:     id,
+			Signal: sig,
+		},
+	}, nil)
+	return err
+}
+
+// Logs copies the buffered output of a job to stdout and stderr and returns
+// the job.
+func (c *Client) Logs(ctx context.Context, id string, stdout, stderr io.Writer) (*JobInfo, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	notifications, err := conn.Request(&protocol.Request{
+		Logs: &protocol.LogsRequest{
+			ID: id,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		go func() {
+			for range notifications {
+			}
+		}()
+	}()
+	var job *JobInfo
+	for job == nil {
+		select {
+		case n, ok := <-notifications:
+			switch {
+			case !ok:
+				return nil, errors.New("daemon closed connection")
+			case n.Error != nil:
+				return nil, errors.New(n.Error.Message)
+			}
+			job = n.Job
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	outStream, err := conn.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	defer outStream.Close()
+	errStream, err := conn.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	defer errStream.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		io.Copy(stderr, errStream)
+		wg.Done()
+	}()
+	io.Copy(stdout, outStream)
+	wg.Wait()
+	return job, nil
+}
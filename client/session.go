@@ -0,0 +1,204 @@
+package client
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/brian14708/rexec/internal/protocol"
+	"github.com/pkg/errors"
+)
+
+// Session is a client connected to a job. Stdout and Stderr have to be read
+// concurrently, the daemon buffers a limited amount of output and then holds
+// back the job until the session reads it.
+type Session struct {
+	// closing Stdin sends EOF to commands without a PTY
+	Stdin  io.WriteCloser
+	Stdout io.Reader
+	Stderr io.Reader
+
+	conn     *protocol.Conn
+	detached bool
+	done     chan struct{}
+
+	mu        sync.Mutex
+	connected *ServerConnected
+	job       *JobInfo
+	exit      *ExitStatus
+	err       error
+}
+
+// start sends req and waits until the daemon reports the job, streams tells
+// whether the request attaches stdio.
+func start(ctx context.Context, conn *protocol.Conn, req *protocol.Request, streams bool) (*Session, error) {
+	notifications, err := conn.Request(req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s := &Session{
+		conn:     conn,
+		detached: !streams,
+		done:     make(chan struct{}),
+	}
+	fail := func(err error) (*Session, error) {
+		conn.Close()
+		go func() {
+			for range notifications {
+			}
+		}()
+		return nil, err
+	}
+
+	// the daemon closes the connection right after reporting a command
+	// that could not be started, which may fail opening the streams
+	var streamErr error
+	if streams {
+		s.Stdin, s.Stdout, s.Stderr, streamErr = openStdio(conn)
+	}
+
+	for s.job == nil && s.exit == nil {
+		select {
+		case n, ok := <-notifications:
+			if !ok && streamErr != nil {
+				return fail(streamErr)
+			}
+			if !ok {
+				return fail(errors.New("daemon closed connection"))
+			}
+			if n.Error != nil {
+				return fail(errors.New(n.Error.Message))
+			}
+			s.handle(n)
+		case <-ctx.Done():
+			return fail(ctx.Err())
+		}
+	}
+
+	if s.job != nil && streamErr != nil {
+		return fail(streamErr)
+	}
+
+	go func() {
+		for n := range notifications {
+			s.handle(n)
+		}
+		close(s.done)
+		conn.Close()
+	}()
+	if streams && req.Exec != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				s.Signal("KILL")
+			case <-s.done:
+			}
+		}()
+	}
+	return s, nil
+}
+
+// openStdio opens the stdio streams of a session, they are empty if that
+// fails.
+func openStdio(conn *protocol.Conn) (io.WriteCloser, io.Reader, io.Reader, error) {
+	var streams []io.ReadWriteCloser
+	for i := 0; i < 3; i++ {
+		stream, err := conn.OpenStream()
+		if err != nil {
+			return nopWriteCloser{ioutil.Discard}, eofReader{}, eofReader{}, err
+		}
+		streams = append(streams, stream)
+	}
+	return streams[0], streams[1], streams[2], nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (s *Session) handle(n *protocol.Notification) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n.Connected != nil {
+		s.connected = n.Connected
+	}
+	if n.Job != nil {
+		s.job = n.Job
+	}
+	if n.Exit != nil {
+		s.exit = n.Exit
+	}
+	if n.Error != nil {
+		s.err = errors.New(n.Error.Message)
+	}
+}
+
+// Connected tells which server runs the command of an Exec session, nil if
+// no server could be connected.
+func (s *Session) Connected() *ServerConnected {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connected
+}
+
+// Job describes the job of the session, nil if the command could not be
+// started.
+func (s *Session) Job() *JobInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.job
+}
+
+// Resize changes the terminal size of a command running with a PTY.
+func (s *Session) Resize(cols, lines int) error {
+	return s.conn.SendNotification(&protocol.Notification{
+		WindowChange: &protocol.WindowChange{
+			TerminalCols:  cols,
+			TerminalLines: lines,
+		},
+	})
+}
+
+// Signal sends a signal to the command, names follow RFC 4254 without the
+// "SIG" prefix, e.g. "INT".
+func (s *Session) Signal(name string) error {
+	return s.conn.SendNotification(&protocol.Notification{
+		Signal: &protocol.Signal{
+			Name: name,
+		},
+	})
+}
+
+// Wait waits for the command to exit and returns its status, the status
+// is nil for detached jobs.
+func (s *Session) Wait() (*ExitStatus, error) {
+	<-s.done
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.exit != nil:
+		return s.exit, nil
+	case s.err != nil:
+		return nil, s.err
+	case s.detached && s.job != nil:
+		return nil, nil
+	}
+	return nil, errors.New("connection to daemon lost")
+}
+
+// Close disconnects from the job, a running job keeps running.
+func (s *Session) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const defaultStartTimeout = 30 * time.Second
+
+// startDaemon spawns rexecd in the background unless another instance is
+// already starting up, and waits until it holds the daemon lock and accepts
+// connections. Clients starting the daemon at the same time are serialized,
+// the later ones find it running.
+func startDaemon(configDir string, config Config) error {
+	sockPath := filepath.Join(configDir, "daemon.sock")
+	lockPath := filepath.Join(configDir, "daemon.sock.lock")
+	logPath := filepath.Join(configDir, "daemon.log")
+
+	start, err := os.OpenFile(filepath.Join(configDir, "daemon.start.lock"), os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrap(err, "cannot create start lock")
+	}
+	defer start.Close()
+	if err := syscall.Flock(int(start.Fd()), syscall.LOCK_EX); err != nil {
+		return errors.Wrap(err, "cannot lock start lock")
+	}
+	defer syscall.Flock(int(start.Fd()), syscall.LOCK_UN)
+
+	if c, err := net.Dial("unix", sockPath); err == nil {
+		c.Close()
+		return nil
+	}
+
+	var exited chan error
+	if !daemonLocked(lockPath) {
+		bin, err := daemonPath(config)
+		if err != nil {
+			return err
+		}
+
+		log, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return errors.Wrap(err, "cannot open daemon log")
+		}
+		defer log.Close()
+
+		cmd := exec.Command(bin, "--config-dir="+configDir)
+		cmd.Stdout = log
+		cmd.Stderr = log
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Setsid: true,
+		}
+		if err := cmd.Start(); err != nil {
+			return errors.Wrap(err, "cannot start daemon")
+		}
+
+		exited = make(chan error, 1)
+		go func() {
+			exited <- cmd.Wait()
+		}()
+	}
+
+	timeout := time.After(config.Client.StartTimeout.Or(defaultStartTimeout))
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		if daemonLocked(lockPath) {
+			if c, err := net.Dial("unix", sockPath); err == nil {
+				c.Close()
+				return nil
+			}
+		}
+
+		select {
+		case err := <-exited:
+			if !daemonLocked(lockPath) {
+				return errors.Errorf("daemon exited (%v), see %s", err, logPath)
+			}
+			// another instance won the lock, wait for it instead
+			exited = nil
+		case <-timeout:
+			return errors.Errorf("timed out waiting for daemon, see %s", logPath)
+		case <-tick.C:
+		}
+	}
+}
+
+// daemonLocked reports whether a daemon instance holds the lock file. The
+// probe briefly takes a shared lock, the daemon retries taking its lock so
+// it does not fail because of it.
+func daemonLocked(lockPath string) bool {
+	f, err := os.Open(lockPath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return true
+	}
+	if err == nil {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	}
+	return false
+}
+
+func daemonPath(config Config) (string, error) {
+	if config.Client.Daemon != "" {
+		return config.Client.Daemon, nil
+	}
+	if self, err := os.Executable(); err == nil {
+		p := filepath.Join(filepath.Dir(self), "rexecd")
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+	}
+	p, err := exec.LookPath("rexecd")
+	if err != nil {
+		return "", errors.Wrap(err, "cannot find rexecd")
+	}
+	return p, nil
+}
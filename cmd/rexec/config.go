@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/BurntSushi/toml"
+	"github.com/brian14708/rexec/internal/cmdutil"
+	"github.com/sirupsen/logrus"
+)
+
+// Config is the client part of config.toml, the rest of the file belongs
+// to rexecd.
+type Config struct {
+	Client struct {
+		// start rexecd when it is not running, defaults to true
+		AutoStart *bool
+		// path of rexecd, defaults to the one next to rexec or in PATH
+		Daemon       string
+		StartTimeout cmdutil.Duration
+	}
+	Profiles map[string]Profile
+}
+
+// Profile holds the client settings of a profile selected with
+// "rexec @name", rexecd applies the rest.
+type Profile struct {
+	// run the command in $SHELL like -s
+	Shell bool
+	// false disables the PTY like -T
+	PTY *bool
+}
+
+func loadConfig(configDir string) Config {
+	var config Config
+	_, err := toml.DecodeFile(filepath.Join(configDir, "config.toml"), &config)
+	if err != nil && !os.IsNotExist(err) {
+		logrus.Fatalf("cannot parse config file: %v", err)
+	}
+	return config
+}
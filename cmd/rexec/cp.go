@@ -0,0 +1,483 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/brian14708/rexec/internal/protocol"
+	"github.com/brian14708/rexec/internal/transfer"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+func cmdCp(configDir string, args []string) int {
+	fs := flag.NewFlagSet("cp", flag.ExitOnError)
+	recursive := fs.Bool("r", false, "Copy directories recursively")
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		logrus.Fatalf("usage: rexec cp [-r] SRC... [SERVER:]DST")
+	}
+	srcs, dst := fs.Args()[:fs.NArg()-1], fs.Arg(fs.NArg()-1)
+
+	server, dstPath, upload := splitRemote(dst)
+	var srcPaths []string
+	for _, src := range srcs {
+		srv, p, remote := splitRemote(src)
+		switch {
+		case upload && remote:
+			logrus.Fatalf("copying between servers is not supported")
+		case !upload && !remote:
+			logrus.Fatalf("one of source and destination has to be SERVER:PATH")
+		case !upload && server != "" && srv != server:
+			logrus.Fatalf("all sources have to be on the same server")
+		}
+		if remote {
+			server = srv
+		}
+		srcPaths = append(srcPaths, p)
+	}
+
+	c, err := dialDaemon(configDir)
+	if err != nil {
+		logrus.Fatalf("%v", err)
+	}
+	defer c.Close()
+	s := &copySession{
+		c:        c,
+		server:   server,
+		progress: terminal.IsTerminal(syscall.Stderr),
+	}
+
+	if upload {
+		err = s.upload(srcPaths, dstPath, *recursive)
+	} else {
+		err = s.download(srcPaths, dstPath, *recursive)
+	}
+	if err != nil {
+		logrus.Errorf("%v", err)
+		return 1
+	}
+	if s.failed {
+		return 1
+	}
+	return 0
+}
+
+// splitRemote splits a "server:path" argument, paths with a slash before
+// the first colon are local like with scp.
+func splitRemote(arg string) (server, p string, remote bool) {
+	i := strings.IndexByte(arg, ':')
+	if i <= 0 || strings.ContainsRune(arg[:i], '/') {
+		return "", arg, false
+	}
+	p = arg[i+1:]
+	if p == "" {
+		p = "."
+	}
+	return arg[:i], p, true
+}
+
+// copySession runs file operations on a server, every operation on its own
+// stream of the daemon connection.
+type copySession struct {
+	c        *protocol.Conn
+	server   string
+	progress bool
+	used     bool
+	failed   bool
+}
+
+func (s *copySession) open(req *protocol.CopyRequest) (*protocol.CommandChan, error) {
+	req.Server = s.server
+	sc := s.c.CommandChan()
+	if s.used {
+		stream, err := s.c.OpenStream()
+		if err != nil {
+			return nil, err
+		}
+		sc = protocol.NewCommandChan(stream)
+	}
+	s.used = true
+	if err := sc.SendRequest(&protocol.Request{Copy: req}); err != nil {
+		sc.Close()
+		return nil, err
+	}
+	return sc, nil
+}
+
+// next reads the next notification of an operation, turning reported
+// errors into errors.
+func next(sc *protocol.CommandChan) (*protocol.Notification, error) {
+	n, err := sc.NextNotification()
+	if err != nil {
+		return nil, err
+	}
+	if n.Error != nil {
+		return nil, errors.New(n.Error.Message)
+	}
+	return n, nil
+}
+
+// fail reports an error about a single file and carries on.
+func (s *copySession) fail(err error) {
+	logrus.Errorf("%v", err)
+	s.failed = true
+}
+
+func (s *copySession) list(p string, recursive bool) ([]protocol.FileInfo, error) {
+	sc, err := s.open(&protocol.CopyRequest{
+		Op:        protocol.CopyList,
+		Path:      p,
+		Recursive: recursive,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer sc.Close()
+	n, err := next(sc)
+	if err != nil {
+		return nil, err
+	}
+	return n.Files, nil
+}
+
+func (s *copySession) simple(req *protocol.CopyRequest) error {
+	sc, err := s.open(req)
+	if err != nil {
+		return err
+	}
+	defer sc.Close()
+	if _, err := next(sc); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+func (s *copySession) upload(srcs []string, dst string, recursive bool) error {
+	files, err := s.list(dst, false)
+	if err != nil {
+		return err
+	}
+	dstDir := len(files) > 0 && files[0].Mode.IsDir()
+	if len(srcs) > 1 && !dstDir {
+		return errors.Errorf("%s is not a directory", dst)
+	}
+
+	for _, src := range srcs {
+		fi, err := os.Stat(src)
+		if err != nil {
+			s.fail(err)
+			continue
+		}
+		target := dst
+		if dstDir {
+			target = path.Join(dst, filepath.Base(src))
+		}
+		if !fi.IsDir() {
+			if err := s.put(src, target, fi); err != nil {
+				s.fail(err)
+			}
+			continue
+		}
+		if !recursive {
+			s.fail(errors.Errorf("omitting directory %s", src))
+			continue
+		}
+		if err := s.uploadDir(src, target); err != nil {
+			s.fail(err)
+		}
+	}
+	return nil
+}
+
+func (s *copySession) uploadDir(src, dst string) error {
+	type dir struct {
+		path string
+		fi   os.FileInfo
+	}
+	var dirs []dir
+	err := filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			s.fail(err)
+			return nil
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := path.Join(dst, filepath.ToSlash(rel))
+
+		if fi.IsDir() {
+			err := s.simple(&protocol.CopyRequest{
+				Op:   protocol.CopyMkdir,
+				Path: target,
+				Mode: fi.Mode() | 0700,
+			})
+			if err != nil {
+				return err
+			}
+			dirs = append(dirs, dir{target, fi})
+			return nil
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			// follow links to regular files
+			if fi, err = os.Stat(p); err != nil {
+				s.fail(err)
+				return nil
+			}
+		}
+		if !fi.Mode().IsRegular() {
+			logrus.Warnf("skipping %s, not a regular file", p)
+			return nil
+		}
+		if err := s.put(p, target, fi); err != nil {
+			s.fail(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// children change the modification time of their parents
+	for i := len(dirs) - 1; i >= 0; i-- {
+		err := s.simple(&protocol.CopyRequest{
+			Op:      protocol.CopySetAttr,
+			Path:    dirs[i].path,
+			Mode:    dirs[i].fi.Mode(),
+			ModTime: dirs[i].fi.ModTime(),
+		})
+		if err != nil {
+			s.fail(err)
+		}
+	}
+	return nil
+}
+
+func (s *copySession) put(src, dst string, fi os.FileInfo) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc, err := s.open(&protocol.CopyRequest{
+		Op:      protocol.CopyPut,
+		Path:    dst,
+		Size:    fi.Size(),
+		Mode:    fi.Mode(),
+		ModTime: fi.ModTime(),
+	})
+	if err != nil {
+		return err
+	}
+	defer sc.Close()
+
+	n, err := next(sc)
+	if err != nil {
+		return errors.Wrapf(err, "cannot copy %s", src)
+	}
+	offset := n.Transfer.Offset
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	p := s.newProgress(src, offset, fi.Size())
+	_, err = io.CopyN(sc, io.TeeReader(f, p), fi.Size()-offset)
+	p.finish()
+	if err != nil {
+		return errors.Wrapf(err, "cannot copy %s", src)
+	}
+	n, err = next(sc)
+	if err == io.EOF || (err == nil && (n.Transfer == nil || !n.Transfer.Done)) {
+		err = errors.New("transfer interrupted")
+	}
+	return errors.Wrapf(err, "cannot copy %s", src)
+}
+
+func (s *copySession) download(srcs []string, dst string, recursive bool) error {
+	fi, err := os.Stat(dst)
+	dstDir := err == nil && fi.IsDir()
+	if len(srcs) > 1 && !dstDir {
+		return errors.Errorf("%s is not a directory", dst)
+	}
+
+	for _, src := range srcs {
+		files, err := s.list(src, recursive)
+		if err != nil {
+			s.fail(err)
+			continue
+		}
+		if len(files) == 0 {
+			s.fail(errors.Errorf("%s: no such file or directory", src))
+			continue
+		}
+		if files[0].Mode.IsDir() && !recursive {
+			s.fail(errors.Errorf("omitting directory %s", src))
+			continue
+		}
+
+		target := dst
+		if dstDir {
+			target = filepath.Join(dst, path.Base(src))
+		}
+		var dirs []protocol.FileInfo
+		for _, f := range files {
+			local := filepath.Join(target, filepath.FromSlash(f.Path))
+			if f.Mode.IsDir() {
+				if err := os.MkdirAll(local, f.Mode.Perm()|0700); err != nil {
+					s.fail(err)
+					continue
+				}
+				f.Path = local
+				dirs = append(dirs, f)
+				continue
+			}
+			if err := s.get(path.Join(src, f.Path), local, f); err != nil {
+				s.fail(err)
+			}
+		}
+		for i := len(dirs) - 1; i >= 0; i-- {
+			os.Chmod(dirs[i].Path, dirs[i].Mode.Perm())
+			os.Chtimes(dirs[i].Path, dirs[i].ModTime, dirs[i].ModTime)
+		}
+	}
+	return nil
+}
+
+func (s *copySession) get(src, dst string, info protocol.FileInfo) error {
+	part := transfer.PartialPath(dst, info.Size, info.ModTime)
+	f, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if offset > info.Size {
+		offset = 0
+	}
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	sc, err := s.open(&protocol.CopyRequest{
+		Op:     protocol.CopyGet,
+		Path:   src,
+		Offset: offset,
+	})
+	if err != nil {
+		return err
+	}
+	defer sc.Close()
+	n, err := next(sc)
+	if err != nil {
+		return errors.Wrapf(err, "cannot copy %s", src)
+	}
+	t := n.Transfer
+	if t.Offset != offset || t.File.Size != info.Size || !t.File.ModTime.Equal(info.ModTime) {
+		return errors.Errorf("%s changed while copying", src)
+	}
+
+	p := s.newProgress(src, offset, info.Size)
+	_, err = io.CopyN(io.MultiWriter(f, p), sc, info.Size-offset)
+	p.finish()
+	if err != nil {
+		return errors.Wrapf(err, "cannot copy %s", src)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(part, dst); err != nil {
+		return err
+	}
+	if err := os.Chmod(dst, info.Mode.Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime, info.ModTime)
+}
+
+// progress shows the state of a single transfer on stderr.
+type progress struct {
+	enabled bool
+	name    string
+	done    int64
+	total   int64
+	resumed int64
+	start   time.Time
+	last    time.Time
+}
+
+func (s *copySession) newProgress(name string, offset, total int64) *progress {
+	return &progress{
+		enabled: s.progress,
+		name:    name,
+		done:    offset,
+		total:   total,
+		resumed: offset,
+		start:   time.Now(),
+	}
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	p.done += int64(len(b))
+	if now := time.Now(); now.Sub(p.last) >= 200*time.Millisecond {
+		p.last = now
+		p.print()
+	}
+	return len(b), nil
+}
+
+func (p *progress) print() {
+	if !p.enabled {
+		return
+	}
+	percent := int64(100)
+	if p.total > 0 {
+		percent = p.done * 100 / p.total
+	}
+	var rate float64
+	if d := time.Since(p.start).Seconds(); d > 0 {
+		rate = float64(p.done-p.resumed) / d
+	}
+	name := p.name
+	if len(name) > 40 {
+		name = "..." + name[len(name)-37:]
+	}
+	fmt.Fprintf(os.Stderr, "\r%-40s %3d%% %9s %9s/s", name, percent, byteCount(p.done), byteCount(int64(rate)))
+}
+
+func (p *progress) finish() {
+	if !p.enabled {
+		return
+	}
+	p.print()
+	fmt.Fprintln(os.Stderr)
+}
+
+func byteCount(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"path/filepath"
+	"syscall"
+
+	"github.com/brian14708/rexec/client"
+	"github.com/brian14708/rexec/internal/protocol"
+	"github.com/pkg/errors"
+)
+
+// dialDaemon connects to rexecd, starting it first if it is not running
+// and auto start is enabled.
+func dialDaemon(configDir string) (*protocol.Conn, error) {
+	sockPath := filepath.Join(configDir, "daemon.sock")
+	c, err := protocol.Dial(sockPath)
+	if retry, serr := autoStart(configDir, err); serr != nil {
+		return nil, serr
+	} else if retry {
+		c, err = protocol.Dial(sockPath)
+	}
+	return c, err
+}
+
+// dialClient is dialDaemon for the client library.
+func dialClient(configDir string) (*client.Client, error) {
+	sockPath := filepath.Join(configDir, "daemon.sock")
+	c, err := client.Dial(sockPath)
+	if retry, serr := autoStart(configDir, err); serr != nil {
+		return nil, serr
+	} else if retry {
+		c, err = client.Dial(sockPath)
+	}
+	return c, err
+}
+
+// autoStart starts the daemon if err tells it is not running and auto start
+// is enabled, it reports whether dialing should be retried.
+func autoStart(configDir string, err error) (bool, error) {
+	if err == nil || !(errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ECONNREFUSED)) {
+		return false, nil
+	}
+	config := loadConfig(configDir)
+	if config.Client.AutoStart != nil && !*config.Client.AutoStart {
+		return false, nil
+	}
+	if err := startDaemon(configDir, config); err != nil {
+		return false, errors.Wrap(err, "failed to start daemon")
+	}
+	return true, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// explicitEnv collects the variables given with -e and --env-file. A bare
+// name given with -e takes its value from the local environment.
+func explicitEnv(vars, files []string) ([]string, error) {
+	var env []string
+	for _, f := range files {
+		e, err := readEnvFile(f)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, e...)
+	}
+	for _, v := range vars {
+		if !strings.Contains(v, "=") {
+			val, ok := os.LookupEnv(v)
+			if !ok {
+				continue
+			}
+			v = v + "=" + val
+		}
+		env = append(env, v)
+	}
+	return env, nil
+}
+
+// readEnvFile parses KEY=VALUE lines, blank lines and lines starting with #
+// are ignored.
+func readEnvFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot open env file")
+	}
+	defer f.Close()
+
+	var env []string
+	s := bufio.NewScanner(f)
+	for lineno := 1; s.Scan(); lineno++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		i := strings.IndexByte(line, '=')
+		if i <= 0 {
+			return nil, errors.Errorf("%s:%d: invalid line", path, lineno)
+		}
+		key, val := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		if len(val) >= 2 && (val[0] == '"' || val[0] == '\'') && val[len(val)-1] == val[0] {
+			val = val[1 : len(val)-1]
+		}
+		env = append(env, key+"="+val)
+	}
+	if err := s.Err(); err != nil {
+		return nil, errors.Wrap(err, "cannot read env file")
+	}
+	return env, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+var errDetach = errors.New("detached")
+
+// escapeReader passes input through unchanged except for the ssh-style
+// escape sequences typed at the beginning of a line: "~." detaches from the
+// session and "~~" sends a literal "~".
+type escapeReader struct {
+	r io.Reader
+
+	started bool
+	tilde   bool
+	pending []byte
+	err     error
+}
+
+func newEscapeReader(r io.Reader) *escapeReader {
+	return &escapeReader{r: r}
+}
+
+func (e *escapeReader) Read(p []byte) (int, error) {
+	if len(e.pending) == 0 && e.err == nil {
+		buf := make([]byte, len(p))
+		n, err := e.r.Read(buf)
+		for _, b := range buf[:n] {
+			if e.tilde {
+				e.tilde = false
+				if b == '.' {
+					err = errDetach
+					break
+				}
+				if b != '~' {
+					e.pending = append(e.pending, '~')
+				}
+				e.pending = append(e.pending, b)
+				e.started = b != '\r' && b != '\n'
+				continue
+			}
+			if !e.started && b == '~' {
+				e.tilde = true
+				continue
+			}
+			e.pending = append(e.pending, b)
+			e.started = b != '\r' && b != '\n'
+		}
+		if err != nil && err != errDetach && e.tilde {
+			// a "~" at the end of the input is not an escape
+			e.tilde = false
+			e.pending = append(e.pending, '~')
+		}
+		e.err = err
+	}
+
+	n := copy(p, e.pending)
+	e.pending = e.pending[n:]
+	if len(e.pending) == 0 {
+		return n, e.err
+	}
+	return n, nil
+}
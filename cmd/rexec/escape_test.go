@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io"
+	"testing"
+)
+
+// chunkReader returns one chunk per Read, like a terminal returning
+// keystrokes as they are typed.
+type chunkReader struct {
+	chunks []string
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.chunks[0])
+	if r.chunks[0] = r.chunks[0][n:]; r.chunks[0] == "" {
+		r.chunks = r.chunks[1:]
+	}
+	return n, nil
+}
+
+func TestEscapeReader(t *testing.T) {
+	tests := []struct {
+		name   string
+		reads  []string
+		want   string
+		detach bool
+	}{
+		{"plain", []string{"ls\n"}, "ls\n", false},
+		{"detach at start", []string{"~."}, "", true},
+		{"detach after newline", []string{"ls\n~.rest"}, "ls\n", true},
+		{"detach after carriage return", []string{"ls\r~."}, "ls\r", true},
+		{"not at line start", []string{"a~.\n"}, "a~.\n", false},
+		{"literal tilde", []string{"~~.\n"}, "~.\n", false},
+		{"literal tilde ends escape", []string{"~~~.\n"}, "~~.\n", false},
+		{"other character", []string{"~x\n"}, "~x\n", false},
+		{"tilde then newline", []string{"~\n~."}, "~\n", true},
+		{"split detach", []string{"ls\n~", "."}, "ls\n", true},
+		{"split literal tilde", []string{"~", "~\n"}, "~\n", false},
+		{"split other character", []string{"\n~", "x"}, "\n~x", false},
+		{"tilde at eof", []string{"a\n~"}, "a\n~", false},
+		{"byte by byte", []string{"a", "\n", "~", "."}, "a\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newEscapeReader(&chunkReader{append([]string(nil), tt.reads...)})
+			var got []byte
+			buf := make([]byte, 4)
+			var err error
+			for err == nil {
+				var n int
+				n, err = r.Read(buf)
+				got = append(got, buf[:n]...)
+			}
+			if string(got) != tt.want {
+				t.Errorf("output = %q, want %q", got, tt.want)
+			}
+			if detached := err == errDetach; detached != tt.detach {
+				t.Errorf("err = %v, want detach %v", err, tt.detach)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/brian14708/rexec/client"
+)
+
+// Event types of the -json-events stream
+const (
+	eventConnected    = "connected"
+	eventServer       = "server"
+	eventStarted      = "started"
+	eventStdout       = "stdout"
+	eventStderr       = "stderr"
+	eventWindowChange = "window-change"
+	eventSignal       = "signal"
+	eventError        = "error"
+	eventExit         = "exit"
+)
+
+// event is a line of the -json-events stream, only the fields relevant to
+// the type are set.
+type event struct {
+	Time  time.Time
+	Event string
+
+	Server  string     `json:",omitempty"`
+	Job     string     `json:",omitempty"`
+	PID     int        `json:",omitempty"`
+	Started *time.Time `json:",omitempty"`
+
+	// output that is not valid UTF-8 is sent base64 encoded in Base64
+	Data   string `json:",omitempty"`
+	Base64 []byte `json:",omitempty"`
+
+	Cols   int    `json:",omitempty"`
+	Lines  int    `json:",omitempty"`
+	Signal string `json:",omitempty"`
+	Error  string `json:",omitempty"`
+
+	// seconds it took the daemon to connect to Server
+	Latency float64 `json:",omitempty"`
+
+	Exit *client.ExitStatus `json:",omitempty"`
+	// seconds from the start of the job to its exit, if the job never
+	// started from the server connection or the start of the session
+	Duration float64 `json:",omitempty"`
+}
+
+// eventLog writes the events of a session as newline delimited JSON.
+// All methods are no-ops on a nil log.
+type eventLog struct {
+	mu        sync.Mutex
+	w         io.WriteCloser
+	enc       *json.Encoder
+	output    bool
+	begin     time.Time
+	connected time.Time
+	started   time.Time
+}
+
+func newEventLog(w io.WriteCloser, output bool) *eventLog {
+	return &eventLog{
+		w:      w,
+		enc:    json.NewEncoder(w),
+		output: output,
+		begin:  time.Now(),
+	}
+}
+
+func (l *eventLog) emit(e *event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	l.mu.Lock()
+	l.enc.Encode(e)
+	l.mu.Unlock()
+}
+
+// Connected records the server connection reported by the daemon.
+func (l *eventLog) Connected(c *client.ServerConnected) {
+	if l == nil {
+		return
+	}
+	now := time.Now()
+	l.mu.Lock()
+	l.connected = now
+	l.mu.Unlock()
+	l.emit(&event{Time: now, Event: eventConnected, Server: c.Server, Latency: c.Latency.Seconds()})
+}
+
+// Started records the job reported by the daemon.
+func (l *eventLog) Started(j *client.JobInfo) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.started = j.Started
+	l.mu.Unlock()
+	l.emit(&event{Event: eventServer, Server: j.Server})
+	started := j.Started
+	l.emit(&event{Event: eventStarted, Server: j.Server, Job: j.ID, PID: j.PID, Started: &started})
+}
+
+// Exit records the exit status of the job, or why it could not be started.
+func (l *eventLog) Exit(st *client.ExitStatus) {
+	if l == nil {
+		return
+	}
+	now := time.Now()
+	l.mu.Lock()
+	since := l.started
+	if since.IsZero() {
+		since = l.connected
+	}
+	if since.IsZero() {
+		since = l.begin
+	}
+	l.mu.Unlock()
+	l.emit(&event{Time: now, Event: eventExit, Exit: st, Duration: now.Sub(since).Seconds()})
+}
+
+// Error records a session that ended without exit status.
+func (l *eventLog) Error(err error) {
+	if l == nil || err == nil {
+		return
+	}
+	l.emit(&event{Event: eventError, Error: err.Error()})
+}
+
+// Resize records a window change sent to the job.
+func (l *eventLog) Resize(cols, lines int) {
+	if l == nil {
+		return
+	}
+	l.emit(&event{Event: eventWindowChange, Cols: cols, Lines: lines})
+}
+
+// Signal records a signal sent to the job.
+func (l *eventLog) Signal(name string) {
+	if l == nil {
+		return
+	}
+	l.emit(&event{Event: eventSignal, Signal: name})
+}
+
+// Stream returns a writer recording output of the stream typ, nil if output
+// is not recorded.
+func (l *eventLog) Stream(typ string) io.Writer {
+	if l == nil || !l.output {
+		return nil
+	}
+	return &eventWriter{l, typ}
+}
+
+func (l *eventLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.w.Close()
+}
+
+type eventWriter struct {
+	l   *eventLog
+	typ string
+}
+
+func (w *eventWriter) Write(p []byte) (int, error) {
+	e := &event{Event: w.typ}
+	if utf8.Valid(p) {
+		e.Data = string(p)
+	} else {
+		e.Base64 = append([]byte(nil), p...)
+	}
+	w.l.emit(e)
+	return len(p), nil
+}
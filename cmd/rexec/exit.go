@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/brian14708/rexec/internal/protocol"
+	"github.com/pkg/errors"
+)
+
+// exitError describes an exit status worth reporting to the user, nil for
+// plain exit codes and signals the user most likely sent themselves.
+func exitError(st *protocol.ExitStatus) error {
+	if st.Category != "" && st.Category != protocol.ErrorRemoteExit {
+		return errors.Errorf("%s: %s", st.Category, st.Error)
+	}
+	if st.Timeout != "" || st.Limit != "" {
+		return errors.New("remote process " + exitDescription(st))
+	}
+	switch st.Signal {
+	case "", "INT", "PIPE":
+		return nil
+	}
+	return errors.New("remote process " + exitDescription(st))
+}
+
+func exitDescription(st *protocol.ExitStatus) string {
+	if st.Category != "" && st.Category != protocol.ErrorRemoteExit {
+		return st.Category
+	}
+	if st.Timeout != "" && st.Killed {
+		return fmt.Sprintf("killed after reaching its %s", st.Timeout)
+	}
+	if st.Timeout != "" {
+		return fmt.Sprintf("terminated after reaching its %s", st.Timeout)
+	}
+	if st.Limit != "" {
+		for _, l := range st.ApproximatedLimits {
+			if l == st.Limit {
+				return fmt.Sprintf("killed for exceeding its %s limit (approximated by rlimits)", st.Limit)
+			}
+		}
+		return fmt.Sprintf("killed for exceeding its %s limit", st.Limit)
+	}
+	if st.Signal == "" {
+		return fmt.Sprintf("exited (%d)", st.ExitCode)
+	}
+	s := "terminated by signal " + st.Signal
+	if st.CoreDumped {
+		s += " (core dumped)"
+	}
+	return s
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/brian14708/rexec/client"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// isFanout reports whether a -H value names more than one server.
+func isFanout(server string) bool {
+	return server == "all" || strings.Contains(server, ",")
+}
+
+// fanoutServers resolves a -H value to server names, "all" selects every
+// server the daemon knows about.
+func fanoutServers(configDir, server string) ([]string, error) {
+	if server != "all" {
+		var names []string
+		for _, name := range strings.Split(server, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+		return names, nil
+	}
+
+	c, err := dialClient(configDir)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	st, err := c.Status(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, s := range st.Servers {
+		names = append(names, s.Name)
+	}
+	return names, nil
+}
+
+type fanoutResult struct {
+	server string
+	exit   *client.ExitStatus
+	err    error
+}
+
+// runFanout runs req on every server at once. Output is prefixed with the
+// server name, or written to outputDir/<server>/{stdout,stderr}. stdin is
+// broadcast to all servers, with a nil stdin the commands read EOF. Returns
+// the highest exit code.
+func runFanout(configDir string, servers []string, opts client.ExecOptions, stdin io.Reader, outputDir string) int {
+	width := 0
+	for _, s := range servers {
+		if len(s) > width {
+			width = len(s)
+		}
+	}
+
+	var stdoutMu, stderrMu sync.Mutex
+	var broadcast *broadcaster
+	if stdin != nil {
+		broadcast = newBroadcaster(stdin, servers)
+	}
+	results := make([]fanoutResult, len(servers))
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		var out, errOut io.WriteCloser
+		if outputDir != "" {
+			var err error
+			out, errOut, err = outputFiles(outputDir, server)
+			if err != nil {
+				logrus.Fatalf("%v", err)
+			}
+		} else {
+			prefix := fmt.Sprintf("%-*s | ", width, server)
+			out = newPrefixWriter(os.Stdout, &stdoutMu, prefix)
+			errOut = newPrefixWriter(os.Stderr, &stderrMu, prefix)
+		}
+
+		wg.Add(1)
+		go func(i int, server string) {
+			defer wg.Done()
+			in := ioutil.NopCloser(strings.NewReader(""))
+			if broadcast != nil {
+				in = broadcast.Reader(i)
+			}
+			defer in.Close()
+			defer out.Close()
+			defer errOut.Close()
+
+			o := opts
+			o.Server = server
+			exit, err := runFanoutOne(configDir, o, stdio{in, out, errOut, nil, nil})
+			results[i] = fanoutResult{server, exit, err}
+		}(i, server)
+	}
+	wg.Wait()
+
+	exitCode := 0
+	w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVER\tEXIT\tSTATUS")
+	for _, r := range results {
+		code, status := 255, ""
+		switch {
+		case r.exit != nil:
+			code, status = r.exit.ExitCode, exitDescription(r.exit)
+			if err := exitError(r.exit); err != nil {
+				status = err.Error()
+			}
+		case r.err != nil:
+			status = r.err.Error()
+		}
+		if code > exitCode {
+			exitCode = code
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\n", r.server, code, status)
+	}
+	w.Flush()
+	return exitCode
+}
+
+func runFanoutOne(configDir string, opts client.ExecOptions, std stdio) (*client.ExitStatus, error) {
+	c, err := dialClient(configDir)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	s, err := c.Exec(context.Background(), opts)
+	if err != nil {
+		return nil, err
+	}
+	_, err = runSession(s, false, std)
+	if st, _ := s.Wait(); st != nil {
+		return st, nil
+	}
+	return nil, err
+}
+
+func outputFiles(dir, server string) (io.WriteCloser, io.WriteCloser, error) {
+	dir = filepath.Join(dir, server)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, err
+	}
+	out, err := os.Create(filepath.Join(dir, "stdout"))
+	if err != nil {
+		return nil, nil, err
+	}
+	errOut, err := os.Create(filepath.Join(dir, "stderr"))
+	if err != nil {
+		out.Close()
+		return nil, nil, err
+	}
+	return out, errOut, nil
+}
+
+// prefixWriter writes complete lines to w with a prefix, lines of writers
+// sharing mu are not interleaved.
+type prefixWriter struct {
+	w      io.Writer
+	mu     *sync.Mutex
+	prefix []byte
+	buf    []byte
+}
+
+func newPrefixWriter(w io.Writer, mu *sync.Mutex, prefix string) *prefixWriter {
+	return &prefixWriter{
+		w:      w,
+		mu:     mu,
+		prefix: []byte(prefix),
+	}
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	i := bytes.LastIndexByte(p.buf, '\n')
+	if i < 0 {
+		return len(b), nil
+	}
+	err := p.writeLines(p.buf[:i+1])
+	p.buf = append(p.buf[:0], p.buf[i+1:]...)
+	return len(b), err
+}
+
+func (p *prefixWriter) writeLines(lines []byte) error {
+	var out []byte
+	for len(lines) > 0 {
+		i := bytes.IndexByte(lines, '\n')
+		out = append(out, p.prefix...)
+		out = append(out, lines[:i+1]...)
+		lines = lines[i+1:]
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err := p.w.Write(out)
+	return err
+}
+
+// Close writes a trailing partial line.
+func (p *prefixWriter) Close() error {
+	if len(p.buf) == 0 {
+		return nil
+	}
+	err := p.writeLines(append(p.buf, '\n'))
+	p.buf = nil
+	return err
+}
+
+// maxQueued is how much stdin is buffered for a server that reads it slower
+// than the others, reading stdin waits once the buffer is full.
+const maxQueued = 4 << 20
+
+// stallTimeout is how long a full buffer may go without being read before
+// the server no longer gets stdin.
+var stallTimeout = 10 * time.Second
+
+// broadcaster copies one reader to several readers. Every reader has its own
+// queue, so a slow reader does not hold up the others until its queue is
+// full, and one that is closed or stalled is dropped.
+type broadcaster struct {
+	names   []string
+	readers []*queueReader
+}
+
+func newBroadcaster(r io.Reader, names []string) *broadcaster {
+	b := &broadcaster{names: names}
+	for range names {
+		q := &queueReader{}
+		q.cond = sync.NewCond(&q.mu)
+		b.readers = append(b.readers, q)
+	}
+	go b.run(r)
+	return b
+}
+
+func (b *broadcaster) run(r io.Reader) {
+	live := make([]int, len(b.readers))
+	for i := range live {
+		live[i] = i
+	}
+	for len(live) > 0 {
+		buf := make([]byte, 32*1024)
+		n, err := r.Read(buf)
+		if n > 0 {
+			next := live[:0]
+			for _, i := range live {
+				switch b.readers[i].push(buf[:n]) {
+				case nil:
+					next = append(next, i)
+				case errStalled:
+					logrus.Warnf("%s: stopped forwarding stdin, the command does not read it", b.names[i])
+				}
+			}
+			live = next
+		}
+		if err != nil {
+			break
+		}
+	}
+	for _, q := range b.readers {
+		q.closeWrite()
+	}
+}
+
+func (b *broadcaster) Reader(i int) io.ReadCloser {
+	return b.readers[i]
+}
+
+var errStalled = errors.New("stdin not read")
+
+// queueReader is a reader of a broadcaster, fed with up to maxQueued bytes
+// ahead of its consumer.
+type queueReader struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	queue [][]byte
+	size  int
+	read  int
+	eof   bool
+	err   error
+}
+
+// push queues p, waiting while the queue is full. It fails if the reader is
+// closed or did not read anything for stallTimeout.
+func (q *queueReader) push(p []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	read, since := q.read, time.Now()
+	for q.err == nil && q.size > 0 && q.size+len(p) > maxQueued {
+		if q.read != read {
+			read, since = q.read, time.Now()
+		}
+		left := stallTimeout - time.Since(since)
+		if left <= 0 {
+			q.err = errStalled
+			q.queue = nil
+			break
+		}
+		t := time.AfterFunc(left, q.cond.Broadcast)
+		q.cond.Wait()
+		t.Stop()
+	}
+	if q.err != nil {
+		return q.err
+	}
+	q.queue = append(q.queue, p)
+	q.size += len(p)
+	q.cond.Broadcast()
+	return nil
+}
+
+func (q *queueReader) closeWrite() {
+	q.mu.Lock()
+	q.eof = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+func (q *queueReader) Read(p []byte) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.queue) == 0 && !q.eof && q.err == nil {
+		q.cond.Wait()
+	}
+	if q.err != nil {
+		return 0, q.err
+	}
+	if len(q.queue) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, q.queue[0])
+	if n == len(q.queue[0]) {
+		q.queue[0] = nil
+		q.queue = q.queue[1:]
+	} else {
+		q.queue[0] = q.queue[0][n:]
+	}
+	q.size -= n
+	q.read += n
+	q.cond.Broadcast()
+	return n, nil
+}
+
+func (q *queueReader) Close() error {
+	q.mu.Lock()
+	if q.err == nil {
+		q.err = io.ErrClosedPipe
+	}
+	q.queue = nil
+	q.mu.Unlock()
+	q.cond.Broadcast()
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPrefixWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   string
+	}{
+		{"empty", nil, ""},
+		{"line", []string{"a\n"}, "p| a\n"},
+		{"lines", []string{"a\nb\n"}, "p| a\np| b\n"},
+		{"split line", []string{"a", "b\n"}, "p| ab\n"},
+		{"split after newline", []string{"a\n", "b\n"}, "p| a\np| b\n"},
+		{"partial at close", []string{"a\nb"}, "p| a\np| b\n"},
+		{"empty line", []string{"\n"}, "p| \n"},
+		{"crlf", []string{"a\r\n"}, "p| a\r\n"},
+		{"byte by byte", []string{"a", "\n", "b", "\n"}, "p| a\np| b\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			var mu sync.Mutex
+			w := newPrefixWriter(&out, &mu, "p| ")
+			for _, s := range tt.writes {
+				if n, err := w.Write([]byte(s)); err != nil || n != len(s) {
+					t.Fatalf("Write(%q) = %d, %v", s, n, err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if got := out.String(); got != tt.want {
+				t.Errorf("output = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrefixWriterInterleaving(t *testing.T) {
+	var out bytes.Buffer
+	var mu sync.Mutex
+	a := newPrefixWriter(&out, &mu, "a| ")
+	b := newPrefixWriter(&out, &mu, "b| ")
+	a.Write([]byte("one "))
+	b.Write([]byte("two\n"))
+	a.Write([]byte("three\n"))
+	if got, want := out.String(), "b| two\na| one three\n"; got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+}
+
+func TestBroadcaster(t *testing.T) {
+	b := newBroadcaster(strings.NewReader("input"), []string{"a", "b"})
+	for i := 0; i < 2; i++ {
+		got, err := ioutil.ReadAll(b.Reader(i))
+		if err != nil || string(got) != "input" {
+			t.Errorf("reader %d = %q, %v", i, got, err)
+		}
+	}
+}
+
+func TestBroadcasterStalledReader(t *testing.T) {
+	defer func(d time.Duration) { stallTimeout = d }(stallTimeout)
+	stallTimeout = 100 * time.Millisecond
+
+	// more than maxQueued for the reader that never reads
+	data := bytes.Repeat([]byte("x"), maxQueued+64*1024)
+	b := newBroadcaster(bytes.NewReader(data), []string{"reading", "stalled", "closed"})
+	b.Reader(2).Close()
+
+	done := make(chan []byte)
+	go func() {
+		got, _ := ioutil.ReadAll(b.Reader(0))
+		done <- got
+	}()
+	select {
+	case got := <-done:
+		if len(got) != len(data) {
+			t.Errorf("reading reader got %d bytes, want %d", len(got), len(data))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stalled reader holds up the others")
+	}
+
+	if _, err := ioutil.ReadAll(b.Reader(1)); err != errStalled {
+		t.Errorf("stalled reader error = %v, want %v", err, errStalled)
+	}
+}
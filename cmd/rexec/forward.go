@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net"
+
+	"github.com/brian14708/rexec/client"
+	"github.com/brian14708/rexec/internal/forward"
+	"github.com/brian14708/rexec/internal/protocol"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+type localForwarder struct {
+	f         *client.Forwarder
+	listeners []net.Listener
+}
+
+// startLocalForwards listens on the local side of every spec and tunnels
+// accepted connections through the daemon to the server, which is resolved
+// like for exec.
+func startLocalForwards(configDir, server, profile string, specs []string) (*localForwarder, error) {
+	var fwds []forward.Spec
+	for _, s := range specs {
+		spec, err := forward.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		fwds = append(fwds, spec)
+	}
+
+	c, err := dialClient(configDir)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	fwd, err := c.Forward(server, profile)
+	if err != nil {
+		return nil, err
+	}
+	f := &localForwarder{f: fwd}
+	go func() {
+		<-fwd.Done()
+		if err := fwd.Err(); err != nil {
+			logrus.Errorf("port forwarding failed: %v", err)
+		}
+	}()
+
+	for _, spec := range fwds {
+		ln, err := net.Listen("tcp", spec.Listen)
+		if err != nil {
+			f.Close()
+			return nil, errors.Wrapf(err, "cannot forward %s", spec.Listen)
+		}
+		f.listeners = append(f.listeners, ln)
+		go f.serve(ln, spec.Connect)
+	}
+	return f, nil
+}
+
+func (f *localForwarder) serve(ln net.Listener, addr string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			rc, err := f.f.Dial("tcp", addr)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			forward.Pipe(conn, rc)
+		}()
+	}
+}
+
+func (f *localForwarder) Close() error {
+	for _, ln := range f.listeners {
+		ln.Close()
+	}
+	return f.f.Close()
+}
+
+// remoteForwards parses -R specs, the listen side is on the server.
+func remoteForwards(specs []string) ([]protocol.RemoteForward, error) {
+	var fwds []protocol.RemoteForward
+	for _, s := range specs {
+		spec, err := forward.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		fwds = append(fwds, protocol.RemoteForward{
+			Listen:  spec.Listen,
+			Connect: spec.Connect,
+		})
+	}
+	return fwds, nil
+}
+
+// dialForward dials the local side of a -R connection.
+func dialForward(network, address string) (net.Conn, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		logrus.Warnf("failed to connect to %s: %v", address, err)
+	}
+	return conn, err
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/brian14708/rexec/internal/protocol"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+func cmdJobs(configDir string, args []string) int {
+	c, err := dialClient(configDir)
+	if err != nil {
+		logrus.Fatalf("%v", err)
+	}
+	defer c.Close()
+
+	jobs, err := c.Jobs(context.Background())
+	if err != nil {
+		logrus.Errorf("%v", err)
+		return 1
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSERVER\tSTATUS\tSTARTED\tCOMMAND")
+	for _, j := range jobs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			j.ID, j.Server, jobState(&j),
+			j.Started.Format(time.Stamp),
+			commandLine(j.Command, j.Args))
+	}
+	w.Flush()
+	return 0
+}
+
+func jobState(j *protocol.JobInfo) string {
+	if j.Exit == nil {
+		if j.Clients == 0 {
+			return "running (detached)"
+		}
+		return "running"
+	}
+	return exitDescription(j.Exit)
+}
+
+func cmdAttach(configDir string, args []string) int {
+	if len(args) > 1 {
+		logrus.Fatalf("usage: rexec attach [id]")
+	}
+	id := ""
+	if len(args) == 1 {
+		id = args[0]
+	}
+
+	c, err := dialClient(configDir)
+	if err != nil {
+		logrus.Fatalf("%v", err)
+	}
+	defer c.Close()
+
+	s, err := c.Attach(context.Background(), id)
+	if err != nil {
+		logrus.Fatalf("%v", err)
+	}
+
+	pty := s.Job().PTY && terminal.IsTerminal(syscall.Stdin)
+	exitCode, err := runSession(s, pty, osStdio)
+	if err != nil {
+		logrus.Errorf("%v", err)
+	}
+	return exitCode
+}
+
+func cmdLogs(configDir string, args []string) int {
+	if len(args) != 1 {
+		logrus.Fatalf("usage: rexec logs <id>")
+	}
+
+	c, err := dialClient(configDir)
+	if err != nil {
+		logrus.Fatalf("%v", err)
+	}
+	defer c.Close()
+
+	if _, err := c.Logs(context.Background(), args[0], os.Stdout, os.Stderr); err != nil {
+		logrus.Errorf("%v", err)
+		return 1
+	}
+	return 0
+}
+
+func cmdKill(configDir string, args []string) int {
+	fs := flag.NewFlagSet("kill", flag.ExitOnError)
+	sig := fs.String("s", "TERM", "Signal to send")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		logrus.Fatalf("usage: rexec kill [-s signal] <id>")
+	}
+
+	c, err := dialClient(configDir)
+	if err != nil {
+		logrus.Fatalf("%v", err)
+	}
+	defer c.Close()
+
+	if err := c.Kill(context.Background(), fs.Arg(0), strings.TrimPrefix(strings.ToUpper(*sig), "SIG")); err != nil {
+		logrus.Errorf("%v", err)
+		return 1
+	}
+	return 0
+}
@@ -1,29 +1,65 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"io"
-	"net"
 	"os"
-	"os/signal"
-	"path/filepath"
 	"strings"
-	"sync"
 	"syscall"
 
 	"github.com/alessio/shellescape"
+	"github.com/brian14708/rexec/client"
+	"github.com/brian14708/rexec/internal/asciicast"
 	"github.com/brian14708/rexec/internal/cmdutil"
-	"github.com/brian14708/rexec/internal/protocol"
+	"github.com/brian14708/rexec/internal/sandbox"
 	"github.com/sirupsen/logrus"
-	"github.com/xtaci/smux"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
 var (
 	flagShell      = flag.Bool("s", false, "Execute inside of shell")
 	flagDisablePTY = flag.Bool("T", false, "Disable PTY")
+	flagNoStdin    = flag.Bool("n", false, "Do not read stdin, the command reads EOF. Implies -T, default on several servers when stdin is a terminal")
+	flagServer     = flag.String("H", "", "Target server, a comma separated list or \"all\" runs on several servers, \"auto\" picks the least loaded one")
+	flagOutputDir  = flag.String("output-dir", "", "Write output of each server to DIR/<server>/{stdout,stderr} when running on several servers")
+	flagDetach     = flag.Bool("d", false, "Run command in background and print its job ID")
+	flagEnv        stringList
+	flagEnvFile    stringList
+	flagRecord     = flag.String("record", "", "Record the session to FILE in asciicast format")
+	flagEvents     = flag.String("json-events", "", "Write session events as newline delimited JSON to FILE, use /dev/fd/N for a file descriptor")
+	flagEventsOut  = flag.Bool("json-events-output", false, "Include stdout and stderr chunks in the -json-events stream")
+	flagTimeout    = flag.Duration("timeout", 0, "Terminate the command after this duration")
+	flagIdle       = flag.Duration("idle-timeout", 0, "Terminate the command after this duration without input or output")
+	flagSync       = flag.Bool("sync", false, "Run in a copy of the working directory synced to the server instead of the mount, defaults to the server setting")
+	flagSyncOutput stringList
+	flagLimits     stringList
+	flagLabels     stringList
+	flagLocalFwd   stringList
+	flagRemoteFwd  stringList
 )
 
+func init() {
+	flag.Var(&flagEnv, "e", "Set remote environment variable KEY=VAL, or forward KEY (repeatable)")
+	flag.Var(&flagEnvFile, "env-file", "Read remote environment variables from file (repeatable)")
+	flag.Var(&flagSyncOutput, "sync-output", "Copy PATH back from the server after the command exits in sync mode (repeatable)")
+	flag.Var(&flagLimits, "limit", "Limit a resource of the command, KEY=VALUE with KEY memory, cpu, tasks or files (repeatable)")
+	flag.Var(&flagLabels, "l", "Only pick servers with label KEY=VALUE for -H auto, implies -H auto (repeatable)")
+	flag.Var(&flagLocalFwd, "L", "Forward local [bind_address:]port to host:hostport on the server (repeatable)")
+	flag.Var(&flagRemoteFwd, "R", "Forward [bind_address:]port on the server to local host:hostport while the command runs (repeatable)")
+}
+
+var subcommands = map[string]func(configDir string, args []string) int{
+	"jobs":   cmdJobs,
+	"attach": cmdAttach,
+	"logs":   cmdLogs,
+	"kill":   cmdKill,
+	"status": cmdStatus,
+	"replay": cmdReplay,
+	"cp":     cmdCp,
+}
+
 func main() {
 	flag.Parse()
 
@@ -33,23 +69,64 @@ func main() {
 
 	configDir := cmdutil.ConfigDir()
 
+	if fn, ok := subcommands[flag.Arg(0)]; ok && !explicitCommand() {
+		os.Exit(fn(configDir, flag.Args()[1:]))
+	}
+	os.Exit(cmdExec(configDir, flag.Args()))
+}
+
+// explicitCommand reports whether the command was separated from the flags
+// with "--", which allows running remote commands named like a subcommand.
+func explicitCommand() bool {
+	n := len(os.Args) - flag.NArg()
+	return n > 0 && os.Args[n-1] == "--"
+}
+
+func cmdExec(configDir string, argv []string) int {
 	cwd, err := os.Getwd()
 	if err != nil {
 		logrus.Fatalf("cannot get current working directory: %v", err)
 	}
 
-	pty := !*flagDisablePTY
+	var profileName string
+	var profile Profile
+	if strings.HasPrefix(argv[0], "@") {
+		profileName = argv[0][1:]
+		p, ok := loadConfig(configDir).Profiles[profileName]
+		if !ok {
+			logrus.Fatalf("unknown profile: %s", profileName)
+		}
+		profile = p
+		if argv = argv[1:]; len(argv) == 0 {
+			logrus.Fatalf("missing command")
+		}
+	}
+
+	labels := map[string]string{}
+	for _, l := range flagLabels {
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) != 2 {
+			logrus.Fatalf("invalid label %q, expected KEY=VALUE", l)
+		}
+		labels[kv[0]] = kv[1]
+	}
+	if len(labels) > 0 {
+		if *flagServer == "" {
+			*flagServer = client.AutoServer
+		} else if *flagServer != client.AutoServer {
+			logrus.Fatalf("-l can only be used with -H auto")
+		}
+	}
+
+	fanout := isFanout(*flagServer)
+	pty := !*flagDisablePTY && !*flagNoStdin && !fanout && (profile.PTY == nil || *profile.PTY)
 	if _, _, err = terminal.GetSize(syscall.Stdin); err != nil {
 		pty = false
 	}
 
 	var cols, lines int
 	var term string
-	var sigWinCh chan os.Signal
 	if pty {
-		sigWinCh = make(chan os.Signal, 1)
-		signal.Notify(sigWinCh, syscall.SIGWINCH)
-
 		cols, lines, err = terminal.GetSize(syscall.Stdin)
 		if err != nil {
 			logrus.Fatalf("cannot get current terminal dimensions: %v", err)
@@ -62,133 +139,206 @@ func main() {
 		}
 	}
 
-	cmd := flag.Args()[0]
-	args := flag.Args()[1:]
-	if *flagShell {
+	cmd := argv[0]
+	args := argv[1:]
+	if *flagShell || profile.Shell {
 		sh := os.Getenv("SHELL")
 		if sh == "" {
 			sh = "/bin/sh"
 		}
 
-		var b strings.Builder
-		b.WriteString(shellescape.Quote(cmd))
-		for _, arg := range args {
-			b.WriteString(" ")
-			b.WriteString(shellescape.Quote(arg))
-		}
 		cmd = sh
 		if pty {
-			args = []string{"-i", "-c", b.String()}
+			args = []string{"-i", "-c", commandLine(argv[0], argv[1:])}
 		} else {
-			args = []string{"-c", b.String()}
+			args = []string{"-c", commandLine(argv[0], argv[1:])}
 		}
 	}
 
-	req := &protocol.Request{
-		Exec: &protocol.ExecRequest{
-			Command:    cmd,
-			Args:       args,
-			WorkingDir: cwd,
-			Env:        os.Environ(),
+	extraEnv, err := explicitEnv(flagEnv, flagEnvFile)
+	if err != nil {
+		logrus.Fatalf("%v", err)
+	}
+	var limits sandbox.Limits
+	for _, l := range flagLimits {
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) != 2 {
+			logrus.Fatalf("invalid limit %q, expected KEY=VALUE", l)
+		}
+		if err := limits.Set(kv[0], kv[1]); err != nil {
+			logrus.Fatalf("%v", err)
+		}
+	}
+	remoteFwd, err := remoteForwards(flagRemoteFwd)
+	if err != nil {
+		logrus.Fatalf("%v", err)
+	}
+	if *flagDetach && (len(flagLocalFwd) > 0 || len(remoteFwd) > 0) {
+		logrus.Fatalf("port forwarding cannot be used with -d")
+	}
+	if *flagDetach && *flagRecord != "" {
+		logrus.Fatalf("-record cannot be used with -d, set Record for the server instead")
+	}
+
+	opts := client.ExecOptions{
+		Server:     *flagServer,
+		Labels:     labels,
+		Detach:     *flagDetach,
+		Profile:    profileName,
+		Command:    cmd,
+		Args:       args,
+		WorkingDir: cwd,
+		Env:        os.Environ(),
+		ExtraEnv:   extraEnv,
+
+		RemoteForward: remoteFwd,
+		DialForward:   dialForward,
+
+		Timeout:     *flagTimeout,
+		IdleTimeout: *flagIdle,
+		Limits:      limits,
 
-			DisablePTY:    !pty,
-			TerminalName:  term,
-			TerminalCols:  cols,
-			TerminalLines: lines,
-		},
+		Sync:        flagIsSet("sync", flagSync),
+		SyncOutputs: flagSyncOutput,
+	}
+	if pty {
+		opts.Terminal = &client.Terminal{
+			Name:  term,
+			Cols:  cols,
+			Lines: lines,
+		}
 	}
 
-	ec := func() int {
-		sockPath := filepath.Join(configDir, "daemon.sock")
-		sock, err := net.Dial("unix", sockPath)
+	if fanout {
+		if *flagDetach || len(flagLocalFwd) > 0 || len(remoteFwd) > 0 || *flagRecord != "" || *flagEvents != "" {
+			logrus.Fatalf("-d, -L, -R, -record and -json-events cannot be used with several servers")
+		}
+		servers, err := fanoutServers(configDir, *flagServer)
 		if err != nil {
-			logrus.Fatalf("failed to connect to daemon: %v", err)
+			logrus.Fatalf("%v", err)
 		}
-		defer sock.Close()
+		// broadcasting a terminal would leave every command waiting for
+		// input the user does not know to type
+		var stdin io.Reader = os.Stdin
+		if *flagNoStdin || terminal.IsTerminal(syscall.Stdin) {
+			stdin = nil
+		}
+		return runFanout(configDir, servers, opts, stdin, *flagOutputDir)
+	}
 
-		sess, err := smux.Client(sock, nil)
+	std := osStdio
+	if *flagNoStdin {
+		std.in = strings.NewReader("")
+	}
+	if *flagEvents != "" {
+		f, err := os.Create(*flagEvents)
 		if err != nil {
-			logrus.Fatalf("failed to create smux session: %v", err)
+			logrus.Fatalf("%v", err)
 		}
-		defer sess.Close()
+		std.events = newEventLog(f, *flagEventsOut)
+		defer std.events.Close()
+	}
 
-		cmdStream, err := sess.OpenStream()
+	c, err := dialClient(configDir)
+	if err != nil {
+		logrus.Fatalf("%v", err)
+	}
+	defer c.Close()
+
+	if len(flagLocalFwd) > 0 {
+		if *flagServer == client.AutoServer {
+			logrus.Fatalf("-L cannot be used with -H auto")
+		}
+		fwd, err := startLocalForwards(configDir, *flagServer, profileName, flagLocalFwd)
 		if err != nil {
-			panic(err)
+			logrus.Fatalf("%v", err)
 		}
-		cmd := protocol.NewCommandChan(cmdStream)
-		defer cmd.Close()
+		defer fwd.Close()
+	}
 
-		cmd.SendRequest(req)
+	s, err := c.Exec(context.Background(), opts)
+	if err != nil {
+		logrus.Fatalf("%v", err)
+	}
+	if srv := s.Connected(); srv != nil {
+		std.events.Connected(srv)
+	}
+	if job := s.Job(); job != nil {
+		std.events.Started(job)
+		if *flagServer == client.AutoServer {
+			fmt.Fprintf(os.Stderr, "[running on %s]\n", job.Server)
+		}
+	}
 
-		inStream, err := sess.OpenStream()
+	if *flagDetach {
+		if job := s.Job(); job != nil {
+			fmt.Println(job.ID)
+			return 0
+		}
+		st, err := s.Wait()
 		if err != nil {
-			panic(err)
+			std.events.Error(err)
+			logrus.Errorf("%v", err)
+			return 255
+		}
+		std.events.Exit(st)
+		if err := exitError(st); err != nil {
+			logrus.Errorf("%v", err)
 		}
-		defer inStream.Close()
+		return st.ExitCode
+	}
 
-		outStream, err := sess.OpenStream()
+	if *flagRecord != "" {
+		f, err := os.Create(*flagRecord)
 		if err != nil {
-			panic(err)
+			logrus.Fatalf("%v", err)
 		}
-		defer outStream.Close()
-
-		errStream, err := sess.OpenStream()
+		std.record, err = asciicast.NewWriter(f, asciicast.Header{
+			Width:   cols,
+			Height:  lines,
+			Command: commandLine(cmd, args),
+			Env: map[string]string{
+				"TERM": term,
+			},
+		})
 		if err != nil {
-			panic(err)
+			logrus.Fatalf("cannot write recording: %v", err)
 		}
-		defer errStream.Close()
-
-		if pty {
-			oldState, _ := terminal.MakeRaw(syscall.Stdin)
-			defer terminal.Restore(syscall.Stdin, oldState)
-			go func() {
-				for range sigWinCh {
-					cols, lines, err := terminal.GetSize(syscall.Stdin)
-					if err == nil {
-						cmd.SendNotification(&protocol.Notification{
-							WindowChange: &protocol.WindowChange{
-								TerminalCols:  cols,
-								TerminalLines: lines,
-							},
-						})
-					}
-				}
-			}()
-		}
-
-		go func() {
-			io.Copy(inStream, os.Stdin)
-			inStream.Close()
-		}()
-
-		var wg sync.WaitGroup
-
-		wg.Add(1)
-		go func() {
-			io.Copy(os.Stderr, errStream)
-			wg.Done()
+		defer func() {
+			if err := std.record.Close(); err != nil {
+				logrus.Errorf("cannot write recording: %v", err)
+			}
 		}()
+	}
 
-		wg.Add(1)
-		go func() {
-			io.Copy(os.Stdout, outStream)
-			wg.Done()
-		}()
+	exitCode, err := runSession(s, pty, std)
+	if err != nil {
+		logrus.Errorf("%v", err)
+	}
+	return exitCode
+}
 
-		wg.Add(1)
-		exitCode := -1
-		go func() {
-			for resp := range cmd.RecvNotification() {
-				if resp.Exit != nil {
-					exitCode = resp.Exit.ExitCode
-				}
-			}
-			wg.Done()
-		}()
+// flagIsSet returns v if the flag was given on the command line, nil
+// otherwise.
+func flagIsSet(name string, v *bool) *bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	if !set {
+		return nil
+	}
+	return v
+}
 
-		wg.Wait()
-		return exitCode
-	}()
-	os.Exit(ec)
+func commandLine(cmd string, args []string) string {
+	var b strings.Builder
+	b.WriteString(shellescape.Quote(cmd))
+	for _, arg := range args {
+		b.WriteString(" ")
+		b.WriteString(shellescape.Quote(arg))
+	}
+	return b.String()
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"time"
+
+	"github.com/brian14708/rexec/internal/asciicast"
+	"github.com/sirupsen/logrus"
+)
+
+func cmdReplay(configDir string, args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	speed := fs.Float64("speed", 1, "Playback speed factor")
+	idle := fs.Duration("idle", 0, "Limit pauses between events to this duration")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		logrus.Fatalf("usage: rexec replay [-speed N] [-idle DURATION] FILE")
+	}
+	if *speed <= 0 {
+		logrus.Fatalf("invalid speed %v", *speed)
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		logrus.Fatalf("%v", err)
+	}
+	defer f.Close()
+	r, err := asciicast.NewReader(f)
+	if err != nil {
+		logrus.Fatalf("%v", err)
+	}
+
+	start := time.Now()
+	var skipped, last time.Duration
+	for {
+		ev, err := r.Next()
+		if err == io.EOF {
+			return 0
+		}
+		if err != nil {
+			logrus.Errorf("%v", err)
+			return 1
+		}
+
+		at := time.Duration(ev.Time / *speed * float64(time.Second))
+		if *idle > 0 && at-last > *idle {
+			skipped += at - last - *idle
+		}
+		last = at
+		time.Sleep(time.Until(start.Add(at - skipped)))
+
+		switch ev.Type {
+		case asciicast.EventOutput:
+			io.WriteString(os.Stdout, ev.Data)
+		case asciicast.EventError:
+			io.WriteString(os.Stderr, ev.Data)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/brian14708/rexec/client"
+	"github.com/brian14708/rexec/internal/asciicast"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// stdio is where a session's remote streams are connected to.
+type stdio struct {
+	in  io.Reader
+	out io.Writer
+	err io.Writer
+
+	// optional, receives output and window changes
+	record *asciicast.Writer
+	// optional, receives the events of the session
+	events *eventLog
+}
+
+var osStdio = stdio{os.Stdin, os.Stdout, os.Stderr, nil, nil}
+
+// runSession connects the local stdio to a remote process and returns its
+// exit code once the daemon reports it, 255 if the command could not be run
+// or the daemon went away. In PTY mode typing "~." at the
+// beginning of a line detaches from the job and leaves it running.
+func runSession(s *client.Session, pty bool, std stdio) (int, error) {
+	detached := false
+	defer func() {
+		// runs after the terminal is restored
+		if job := s.Job(); detached && job != nil {
+			fmt.Fprintf(os.Stderr, "[detached from job %s]\n", job.ID)
+		}
+	}()
+	defer s.Close()
+
+	if pty {
+		sigWinCh := make(chan os.Signal, 1)
+		signal.Notify(sigWinCh, syscall.SIGWINCH)
+		defer signal.Stop(sigWinCh)
+
+		oldState, _ := terminal.MakeRaw(syscall.Stdin)
+		defer terminal.Restore(syscall.Stdin, oldState)
+		sigWinCh <- syscall.SIGWINCH
+		go func() {
+			for range sigWinCh {
+				cols, lines, err := terminal.GetSize(syscall.Stdin)
+				if err == nil {
+					if std.record != nil {
+						std.record.Resize(cols, lines)
+					}
+					std.events.Resize(cols, lines)
+					s.Resize(cols, lines)
+				}
+			}
+		}()
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, forwardedSignals()...)
+	defer signal.Stop(sigCh)
+	go func() {
+		for sig := range sigCh {
+			std.events.Signal(forwardSignals[sig])
+			s.Signal(forwardSignals[sig])
+		}
+	}()
+
+	detach := make(chan struct{})
+	go func() {
+		stdin := std.in
+		if pty {
+			stdin = newEscapeReader(stdin)
+		}
+		_, err := io.Copy(s.Stdin, stdin)
+		if err == errDetach {
+			close(detach)
+			return
+		}
+		s.Stdin.Close()
+	}()
+
+	stdout, stderr := std.out, std.err
+	if std.record != nil {
+		stdout = io.MultiWriter(stdout, std.record.Stream(asciicast.EventOutput))
+		stderr = io.MultiWriter(stderr, std.record.Stream(asciicast.EventError))
+	}
+	if w := std.events.Stream(eventStdout); w != nil {
+		stdout = io.MultiWriter(stdout, w)
+	}
+	if w := std.events.Stream(eventStderr); w != nil {
+		stderr = io.MultiWriter(stderr, w)
+	}
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		io.Copy(stderr, s.Stderr)
+		wg.Done()
+	}()
+
+	wg.Add(1)
+	go func() {
+		io.Copy(stdout, s.Stdout)
+		wg.Done()
+	}()
+
+	wg.Add(1)
+	exitCode := 255
+	var exitErr error
+	go func() {
+		st, err := s.Wait()
+		if st != nil {
+			std.events.Exit(st)
+			exitCode = st.ExitCode
+			exitErr = exitError(st)
+		} else {
+			std.events.Error(err)
+			exitErr = err
+		}
+		wg.Done()
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return exitCode, exitErr
+	case <-detach:
+		detached = true
+		return 0, nil
+	}
+}
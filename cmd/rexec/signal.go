@@ -0,0 +1,23 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+var forwardSignals = map[os.Signal]string{
+	syscall.SIGINT:  "INT",
+	syscall.SIGTERM: "TERM",
+	syscall.SIGHUP:  "HUP",
+	syscall.SIGQUIT: "QUIT",
+	syscall.SIGUSR1: "USR1",
+	syscall.SIGUSR2: "USR2",
+}
+
+func forwardedSignals() []os.Signal {
+	sigs := make([]os.Signal, 0, len(forwardSignals))
+	for s := range forwardSignals {
+		sigs = append(sigs, s)
+	}
+	return sigs
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/brian14708/rexec/internal/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+func cmdStatus(configDir string, args []string) int {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "Print status as JSON")
+	fs.Parse(args)
+
+	c, err := dialClient(configDir)
+	if err != nil {
+		logrus.Fatalf("%v", err)
+	}
+	defer c.Close()
+
+	st, err := c.Status(context.Background())
+	if err != nil {
+		logrus.Errorf("%v", err)
+		return 1
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(st)
+	} else {
+		printStatus(st)
+	}
+	return 0
+}
+
+func printStatus(st *protocol.StatusReport) {
+	fmt.Printf("rexecd up %s (since %s)\n",
+		st.Uptime.Round(time.Second), st.Started.Format(time.RFC1123))
+	if st.ConfigError != "" {
+		fmt.Printf("config not reloaded, using the one from %s: %s\n",
+			st.ConfigLoaded.Format(time.RFC1123), st.ConfigError)
+	}
+	fmt.Println()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVER\tHOST\tCONNECTION\tMOUNT\tLOAD\tERROR")
+	for _, s := range st.Servers {
+		load := "-"
+		if l := s.Load; l != nil {
+			load = fmt.Sprintf("%.2f/%d %s free", l.Load1, l.CPUs, byteCount(l.MemAvailable))
+		}
+		errMsg := s.Error
+		if !s.Retry.IsZero() {
+			errMsg += fmt.Sprintf(" (retry in %s)", time.Until(s.Retry).Round(time.Second))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			s.Name, s.Host, s.Connection, s.Mount, load, errMsg)
+	}
+	w.Flush()
+
+	if len(st.Sessions) == 0 {
+		fmt.Println("\nno active sessions")
+		return
+	}
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSERVER\tPID\tSTARTED\tCLIENT\tCOMMAND")
+	for _, j := range st.Sessions {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n",
+			j.ID, j.Server, j.PID, j.Started.Format(time.Stamp),
+			j.Client, commandLine(j.Command, j.Args))
+	}
+	w.Flush()
+}
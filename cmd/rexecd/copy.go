@@ -0,0 +1,234 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/brian14708/rexec/internal/protocol"
+	"github.com/brian14708/rexec/internal/transfer"
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+	"github.com/xtaci/smux"
+)
+
+// handleCopy serves the file operations of a copy session over a single
+// SFTP session to the server, one operation per stream.
+func (d *daemon) handleCopy(session *smux.Session, cmd *protocol.CommandChan, req *protocol.CopyRequest) {
+	srv, err := d.lookupServer(req.Server)
+	if err != nil {
+		sendError(cmd, err)
+		return
+	}
+	conn, err := srv.Conn()
+	if err != nil {
+		sendError(cmd, err)
+		return
+	}
+	defer srv.use()()
+	client, err := conn.SFTP()
+	if err != nil {
+		sendError(cmd, errors.Wrap(err, "failed to start sftp session"))
+		return
+	}
+	defer client.Close()
+
+	for {
+		if err := copyOp(client, cmd, req); err != nil {
+			sendError(cmd, err)
+		}
+		cmd.Close()
+
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		cmd = protocol.NewCommandChan(stream)
+		r, err := cmd.RecvRequest()
+		if err != nil || r.Copy == nil {
+			logrus.Warnf("invalid copy stream: %v", err)
+			cmd.Close()
+			return
+		}
+		req = r.Copy
+	}
+}
+
+func copyOp(client *sftp.Client, cmd *protocol.CommandChan, req *protocol.CopyRequest) error {
+	switch req.Op {
+	case protocol.CopyList:
+		files, err := listFiles(client, req.Path, req.Recursive)
+		if err != nil {
+			return err
+		}
+		return cmd.SendNotification(&protocol.Notification{
+			Files: files,
+		})
+
+	case protocol.CopyMkdir:
+		if err := client.MkdirAll(req.Path); err != nil {
+			return errors.Wrapf(err, "cannot create %s", req.Path)
+		}
+		return client.Chmod(req.Path, req.Mode.Perm())
+
+	case protocol.CopySetAttr:
+		if err := client.Chmod(req.Path, req.Mode.Perm()); err != nil {
+			return err
+		}
+		return client.Chtimes(req.Path, req.ModTime, req.ModTime)
+
+	case protocol.CopyPut:
+		return putFile(client, cmd, req)
+
+	case protocol.CopyGet:
+		return getFile(client, cmd, req)
+	}
+	return errors.Errorf("unsupported copy operation: %s", req.Op)
+}
+
+func listFiles(client *sftp.Client, root string, recursive bool) ([]protocol.FileInfo, error) {
+	files := []protocol.FileInfo{}
+	fi, err := client.Stat(root)
+	if os.IsNotExist(err) {
+		return files, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, fileInfo(".", fi))
+	if !fi.IsDir() || !recursive {
+		return files, nil
+	}
+
+	root = path.Clean(root)
+	w := client.Walk(root)
+	w.Step()
+	for w.Step() {
+		if err := w.Err(); err != nil {
+			return nil, err
+		}
+		rel := w.Path()
+		if root != "." {
+			rel = strings.TrimPrefix(rel, strings.TrimSuffix(root, "/")+"/")
+		}
+		fi := w.Stat()
+		if fi.Mode()&os.ModeSymlink != 0 {
+			// follow links to regular files, skip the rest
+			if fi, err = client.Stat(w.Path()); err != nil || !fi.Mode().IsRegular() {
+				continue
+			}
+		}
+		if !fi.IsDir() && !fi.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, fileInfo(rel, fi))
+	}
+	return files, nil
+}
+
+func fileInfo(rel string, fi os.FileInfo) protocol.FileInfo {
+	return protocol.FileInfo{
+		Path:    rel,
+		Size:    fi.Size(),
+		Mode:    fi.Mode(),
+		ModTime: fi.ModTime(),
+	}
+}
+
+// putFile receives a file into a partial file next to its destination and
+// renames it into place once complete.
+func putFile(client *sftp.Client, cmd *protocol.CommandChan, req *protocol.CopyRequest) error {
+	part := transfer.PartialPath(req.Path, req.Size, req.ModTime)
+	var offset int64
+	if fi, err := client.Stat(part); err == nil && fi.Size() <= req.Size {
+		offset = fi.Size()
+	}
+
+	f, err := client.OpenFile(part, os.O_WRONLY|os.O_CREATE)
+	if err != nil {
+		return errors.Wrapf(err, "cannot create %s", part)
+	}
+	defer f.Close()
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	err = cmd.SendNotification(&protocol.Notification{
+		Transfer: &protocol.TransferInfo{
+			Offset: offset,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(f, cmd, req.Size-offset); err != nil {
+		return errors.Wrapf(err, "failed to write %s", req.Path)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := client.PosixRename(part, req.Path); err != nil {
+		client.Remove(req.Path)
+		if err := client.Rename(part, req.Path); err != nil {
+			return errors.Wrapf(err, "cannot rename to %s", req.Path)
+		}
+	}
+	if err := client.Chmod(req.Path, req.Mode.Perm()); err != nil {
+		return err
+	}
+	if err := client.Chtimes(req.Path, req.ModTime, req.ModTime); err != nil {
+		return err
+	}
+	return cmd.SendNotification(&protocol.Notification{
+		Transfer: &protocol.TransferInfo{
+			Offset: req.Size,
+			Done:   true,
+		},
+	})
+}
+
+// getFile sends a file from req.Offset on, the client keeps track of
+// partial downloads.
+func getFile(client *sftp.Client, cmd *protocol.CommandChan, req *protocol.CopyRequest) error {
+	f, err := client.Open(req.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return errors.Errorf("%s is a directory", req.Path)
+	}
+
+	offset := req.Offset
+	if offset < 0 || offset > fi.Size() {
+		offset = 0
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	err = cmd.SendNotification(&protocol.Notification{
+		Transfer: &protocol.TransferInfo{
+			Offset: offset,
+			File:   fileInfo(path.Base(req.Path), fi),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	// the client notices a short transfer, an error would end up in the
+	// data
+	if _, err := io.CopyN(cmd, f, fi.Size()-offset); err != nil {
+		logrus.Warnf("failed to send %s: %v", req.Path, err)
+	}
+	return nil
+}
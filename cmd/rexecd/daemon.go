@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/brian14708/rexec/internal/protocol"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/xtaci/smux"
+)
+
+type daemon struct {
+	started   time.Time
+	configDir string
+	jobs      *jobTable
+
+	// replaced on reload, see current
+	configMu  sync.RWMutex
+	config    Config
+	servers   map[string]*server
+	loaded    time.Time
+	configErr error
+	// counts reloads that connected servers, see mountPoint
+	generation int
+
+	mu        sync.Mutex
+	syncLocks map[string]*sync.Mutex
+}
+
+func (d *daemon) handleConnection(c net.Conn) {
+	defer c.Close()
+
+	// Setup server side of smux
+	session, err := smux.Server(c, nil)
+	if err != nil {
+		logrus.Warnf("failed to create smux session: %v", err)
+		return
+	}
+	defer session.Close()
+
+	// Accept a stream
+	stream, err := session.AcceptStream()
+	if err != nil {
+		logrus.Warnf("failed to accept stream: %v", err)
+		return
+	}
+	cmd := protocol.NewCommandChan(stream)
+	defer cmd.Close()
+
+	req, err := cmd.RecvRequest()
+	if err != nil {
+		logrus.Warnf("invalid request format: %v", err)
+		return
+	}
+	fmt.Println(req)
+
+	switch {
+	case req.Exec != nil:
+		d.handleExec(session, cmd, req.Exec, peerName(c))
+	case req.Jobs != nil:
+		d.handleJobs(cmd)
+	case req.Attach != nil:
+		d.handleAttach(session, cmd, req.Attach)
+	case req.Logs != nil:
+		d.handleLogs(session, cmd, req.Logs)
+	case req.Kill != nil:
+		d.handleKill(cmd, req.Kill)
+	case req.Status != nil:
+		d.handleStatus(cmd)
+	case req.Forward != nil:
+		d.handleForward(session, cmd, req.Forward)
+	case req.Copy != nil:
+		d.handleCopy(session, cmd, req.Copy)
+	default:
+		sendError(cmd, errors.New("unsupported request"))
+	}
+}
+
+func (d *daemon) lookupServer(name string) (*server, error) {
+	if name == "" {
+		name = d.conf().DefaultServer
+	}
+	if name == "" {
+		name = "local"
+	}
+	_, servers := d.current()
+	srv, ok := servers[name]
+	if !ok {
+		return nil, &execError{protocol.ErrorConnect, fmt.Errorf("unknown server: %s", name)}
+	}
+	if _, err := srv.Conn(); err != nil {
+		category := protocol.ErrorConnect
+		if e, ok := err.(*execError); ok {
+			category, err = e.category, e.err
+		}
+		return nil, &execError{category, errors.Wrapf(err, "server %s unavailable", name)}
+	}
+	return srv, nil
+}
+
+func (d *daemon) lookupJob(id string) (*job, error) {
+	if id == "" {
+		if j := d.jobs.Latest(); j != nil {
+			return j, nil
+		}
+		return nil, errors.New("no detached job")
+	}
+	j := d.jobs.Get(id)
+	if j == nil {
+		return nil, fmt.Errorf("unknown job: %s", id)
+	}
+	return j, nil
+}
+
+// profile returns the named profile, the zero profile for an empty name.
+func (d *daemon) profile(name string) (ProfileConfig, error) {
+	if name == "" {
+		return ProfileConfig{}, nil
+	}
+	p, ok := d.conf().Profiles[name]
+	if !ok {
+		return p, fmt.Errorf("unknown profile: %s", name)
+	}
+	return p, nil
+}
+
+func (d *daemon) handleJobs(cmd *protocol.CommandChan) {
+	infos := []protocol.JobInfo{}
+	for _, j := range d.jobs.List() {
+		infos = append(infos, j.Info())
+	}
+	cmd.SendNotification(&protocol.Notification{
+		Jobs: infos,
+	})
+}
+
+func (d *daemon) handleAttach(session *smux.Session, cmd *protocol.CommandChan, req *protocol.AttachRequest) {
+	j, err := d.lookupJob(req.ID)
+	if err != nil {
+		sendError(cmd, err)
+		return
+	}
+	info := j.Info()
+	cmd.SendNotification(&protocol.Notification{
+		Job: &info,
+	})
+	d.attachJob(session, cmd, j, false)
+}
+
+func (d *daemon) handleLogs(session *smux.Session, cmd *protocol.CommandChan, req *protocol.LogsRequest) {
+	j, err := d.lookupJob(req.ID)
+	if err != nil {
+		sendError(cmd, err)
+		return
+	}
+	info := j.Info()
+	cmd.SendNotification(&protocol.Notification{
+		Job: &info,
+	})
+
+	outStream, err := session.AcceptStream()
+	if err != nil {
+		logrus.Warnf("failed to accept stream: %v", err)
+		return
+	}
+	defer outStream.Close()
+	errStream, err := session.AcceptStream()
+	if err != nil {
+		logrus.Warnf("failed to accept stream: %v", err)
+		return
+	}
+	defer errStream.Close()
+
+	copyOutput(j.output, 0, false, outStream, errStream)
+}
+
+func (d *daemon) handleKill(cmd *protocol.CommandChan, req *protocol.KillRequest) {
+	j, err := d.lookupJob(req.ID)
+	if err != nil {
+		sendError(cmd, err)
+		return
+	}
+	if j.Status() != nil {
+		d.jobs.Remove(j.id)
+		return
+	}
+
+	sig := req.Signal
+	if sig == "" {
+		sig = "TERM"
+	}
+	if err := j.Signal(sig); err != nil {
+		sendError(cmd, errors.Wrapf(err, "failed to signal job %s", j.id))
+	}
+}
+
+func (d *daemon) handleStatus(cmd *protocol.CommandChan) {
+	report := &protocol.StatusReport{
+		Started:  d.started,
+		Uptime:   time.Since(d.started),
+		Servers:  []protocol.ServerStatus{},
+		Sessions: []protocol.JobInfo{},
+	}
+	d.configMu.RLock()
+	report.ConfigLoaded = d.loaded
+	if d.configErr != nil {
+		report.ConfigError = d.configErr.Error()
+	}
+	d.configMu.RUnlock()
+
+	_, servers := d.current()
+	names := make([]string, 0, len(servers))
+	for name := range servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		report.Servers = append(report.Servers, servers[name].Status())
+	}
+
+	for _, j := range d.jobs.List() {
+		if j.Status() == nil {
+			report.Sessions = append(report.Sessions, j.Info())
+		}
+	}
+
+	cmd.SendNotification(&protocol.Notification{
+		Status: report,
+	})
+}
+
+// peerName describes the process on the other end of a unix socket.
+func peerName(c net.Conn) string {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return c.RemoteAddr().String()
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return ""
+	}
+
+	var cred *syscall.Ucred
+	raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || cred == nil {
+		return ""
+	}
+
+	comm, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/comm", cred.Pid))
+	if err != nil {
+		return fmt.Sprintf("pid %d", cred.Pid)
+	}
+	return fmt.Sprintf("%s[%d]", strings.TrimSpace(string(comm)), cred.Pid)
+}
+
+func sendError(cmd *protocol.CommandChan, err error) {
+	cmd.SendNotification(&protocol.Notification{
+		Error: &protocol.Error{
+			Message: err.Error(),
+		},
+	})
+}
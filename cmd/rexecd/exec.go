@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/brian14708/rexec/internal/protocol"
+	"github.com/brian14708/rexec/internal/sandbox"
+	"github.com/brian14708/rexec/internal/sshconn"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/xtaci/smux"
+	"golang.org/x/crypto/ssh"
+)
+
+// execError is a failure to run a command, the category tells which step
+// failed.
+type execError struct {
+	category string
+	err      error
+}
+
+func (e *execError) Error() string {
+	return e.err.Error()
+}
+
+// sendExecError reports a command that could not be run as its exit status.
+func sendExecError(cmd *protocol.CommandChan, err error) {
+	category := protocol.ErrorSpawn
+	if e, ok := err.(*execError); ok {
+		category = e.category
+	}
+	cmd.SendNotification(&protocol.Notification{
+		Exit: &protocol.ExitStatus{
+			ExitCode: 255,
+			Error:    err.Error(),
+			Category: category,
+		},
+	})
+}
+
+func (d *daemon) handleExec(session *smux.Session, cmd *protocol.CommandChan, req *protocol.ExecRequest, client string) {
+	p, err := d.profile(req.Profile)
+	if err != nil {
+		sendExecError(cmd, &execError{protocol.ErrorSpawn, err})
+		return
+	}
+	srv, err := d.resolveServer(req.Server, p, req.Labels)
+	if err != nil {
+		sendExecError(cmd, err)
+		return
+	}
+	cmd.SendNotification(&protocol.Notification{
+		Connected: &protocol.ServerConnected{
+			Server:  srv.name,
+			Latency: srv.Latency(),
+		},
+	})
+
+	j, err := d.startJob(session, srv, p, req, client)
+	if err != nil {
+		sendExecError(cmd, err)
+		return
+	}
+	// report the job once the sandbox is running so the PID is known
+	j.cmd.WaitPID()
+	info := j.Info()
+	cmd.SendNotification(&protocol.Notification{
+		Job: &info,
+	})
+
+	if req.Detach {
+		if !j.pty {
+			j.stdin.Close()
+		}
+		return
+	}
+	d.attachJob(session, cmd, j, true)
+}
+
+// resolveServer returns the server a request runs on, name falls back to
+// the server of the profile and then to the default server.
+func (d *daemon) resolveServer(name string, p ProfileConfig, labels map[string]string) (*server, error) {
+	if name == "" {
+		name = p.Server
+	}
+	if name == protocol.AutoServer {
+		return d.pickServer(labels)
+	}
+	return d.lookupServer(name)
+}
+
+func (d *daemon) startJob(session *smux.Session, srv *server, p ProfileConfig, req *protocol.ExecRequest, client string) (_ *job, err error) {
+	conn, err := srv.Conn()
+	if err != nil {
+		return nil, err
+	}
+	release := srv.use()
+	defer func() {
+		if err != nil {
+			release()
+		}
+	}()
+
+	m, err := d.pathMapper(srv, p)
+	if err != nil {
+		return nil, &execError{protocol.ErrorSpawn, err}
+	}
+	s, err := d.sandboxSpec(srv, p, m, req)
+	if err != nil {
+		return nil, &execError{protocol.ErrorSpawn, err}
+	}
+	cfg := d.conf().Servers[srv.name]
+	timeout, idle := req.Timeout, req.IdleTimeout
+	if timeout == 0 {
+		timeout = p.Timeout.Or(cfg.Timeout.Or(0))
+	}
+	if idle == 0 {
+		idle = p.IdleTimeout.Or(cfg.IdleTimeout.Or(0))
+	}
+	var approximated []string
+	if s.Limits.NeedsScope() {
+		if err := checkScope(conn, s.Limits); err != nil {
+			if s.Limits.CPU > 0 && timeout == 0 {
+				return nil, &execError{protocol.ErrorSpawn, errors.Wrapf(err, "cannot enforce the cpu limit on %s without a timeout", srv.name)}
+			}
+			logrus.Warnf("approximating limits on %s with rlimits: %v", srv.name, err)
+			s.LimitScope = ""
+			s.LimitTimeout = timeout
+			approximated = s.Limits.Approximated()
+		}
+	}
+	synced, err := d.syncWorkdir(conn, srv, req)
+	if err != nil {
+		return nil, &execError{protocol.ErrorSpawn, err}
+	}
+	if synced != nil {
+		s.Bind = append(s.Bind, sandbox.BindSpec{
+			Dst:  s.WorkingDir,
+			Src:  synced.tree.Remote,
+			Type: sandbox.BindReadWrite,
+		})
+	}
+	args := s.CommandArgs()
+	cc, err := conn.RunCommand(context.TODO(), args[0], args[1:]...)
+	if err != nil {
+		return nil, &execError{protocol.ErrorSpawn, errors.Wrap(err, "failed to create session")}
+	}
+	cc.ReportPID = true
+	var j *job
+	defer func() {
+		if err == nil {
+			return
+		}
+		cc.Close()
+		if j == nil {
+			return
+		}
+		j.closeListeners()
+		if j.record != nil {
+			j.record.Close()
+		}
+	}()
+	var scope string
+	if s.Limits.NeedsScope() {
+		scope = s.LimitScope
+	}
+
+	now := time.Now()
+	j = &job{
+		server:   srv.name,
+		command:  req.Command,
+		args:     req.Args,
+		started:  now,
+		detached: req.Detach,
+		pty:      !req.DisablePTY,
+		client:   client,
+
+		cmd:    cc,
+		conn:   conn,
+		spec:   s,
+		output: newOutputBuffer(d.conf().Scrollback),
+		done:   make(chan struct{}),
+		active: now,
+		scope:  scope,
+		sync:   synced,
+
+		approximated: approximated,
+
+		release: release,
+	}
+	if j.record, err = d.startRecording(srv, req, j.started); err != nil {
+		logrus.Warnf("cannot record job: %v", err)
+	}
+	stdout := m.OutputWriter(j.recorded(streamStdout))
+	stderr := m.OutputWriter(j.recorded(streamStderr))
+	j.flush = []io.Closer{stdout, stderr}
+	cc.Stdout = stdout
+	cc.Stderr = stderr
+	if j.stdin, err = cc.StdinPipe(); err != nil {
+		return nil, &execError{protocol.ErrorSpawn, errors.Wrap(err, "failed to connect stdin")}
+	}
+
+	if j.listeners, err = listenRemote(conn, session, req.RemoteForward); err != nil {
+		return nil, &execError{protocol.ErrorSpawn, err}
+	}
+	if j.pty {
+		modes := ssh.TerminalModes{
+			ssh.TTY_OP_ISPEED: 115200,
+			ssh.TTY_OP_OSPEED: 115200,
+		}
+		err = cc.StartPTY(req.TerminalName, req.TerminalLines, req.TerminalCols, modes)
+	} else {
+		err = cc.Start()
+	}
+	if err != nil {
+		return nil, &execError{protocol.ErrorSpawn, errors.Wrap(err, "failed to start command")}
+	}
+
+	d.jobs.Add(j)
+	go j.wait()
+
+	if timeout > 0 || idle > 0 {
+		go j.enforceTimeouts(timeout, idle)
+	}
+	return j, nil
+}
+
+// runRemote runs a command next to the sandboxes of a server and waits for
+// it, the error includes what the command wrote to stderr.
+func runRemote(conn *sshconn.Conn, args []string) error {
+	cc, err := conn.RunCommand(context.TODO(), args[0], args[1:]...)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	cc.Stderr = &out
+	if err := cc.Start(); err != nil {
+		return err
+	}
+	if err := cc.Wait(); err != nil {
+		if msg := strings.TrimSpace(out.String()); msg != "" {
+			return errors.New(msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// attachJob connects the stdio streams of a client session to a job until
+// the job exits or the client goes away, replaying the buffered output
+// first. The job keeps running when the client disconnects. The owner is
+// the client that started the job, for non-PTY jobs its stdin EOF is passed
+// on to the remote process.
+func (d *daemon) attachJob(session *smux.Session, cmd *protocol.CommandChan, j *job, owner bool) {
+	inStream, err := session.AcceptStream()
+	if err != nil {
+		logrus.Warnf("failed to accept stream: %v", err)
+		return
+	}
+	defer inStream.Close()
+
+	outStream, err := session.AcceptStream()
+	if err != nil {
+		logrus.Warnf("failed to accept stream: %v", err)
+		return
+	}
+	defer outStream.Close()
+
+	errStream, err := session.AcceptStream()
+	if err != nil {
+		logrus.Warnf("failed to accept stream: %v", err)
+		return
+	}
+	defer errStream.Close()
+
+	j.addClient(1)
+	defer j.addClient(-1)
+
+	go func() {
+		io.Copy(touchWriter{j.stdin, j}, inStream)
+		if owner && !j.pty {
+			j.stdin.Close()
+		}
+	}()
+
+	gone := make(chan struct{})
+	go func() {
+		for req := range cmd.RecvNotification() {
+			if wc := req.WindowChange; wc != nil {
+				j.cmd.WindowChange(wc.TerminalLines, wc.TerminalCols)
+				if j.record != nil {
+					j.record.Resize(wc.TerminalCols, wc.TerminalLines)
+				}
+			}
+			if s := req.Signal; s != nil {
+				if err := j.Signal(s.Name); err != nil {
+					logrus.Warnf("failed to deliver signal %s: %v", s.Name, err)
+				}
+			}
+		}
+		close(gone)
+	}()
+
+	copied := make(chan struct{})
+	go func() {
+		copyOutput(j.output, 0, true, outStream, errStream)
+		outStream.Close()
+		errStream.Close()
+		close(copied)
+	}()
+
+	select {
+	case <-copied:
+	case <-gone:
+	}
+	select {
+	case <-j.done:
+		err := cmd.SendNotification(&protocol.Notification{
+			Exit: j.Status(),
+		})
+		if err == nil {
+			d.jobs.Remove(j.id)
+		}
+	case <-gone:
+		logrus.Infof("client detached from job %s", j.id)
+	}
+}
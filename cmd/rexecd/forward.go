@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net"
+
+	"github.com/brian14708/rexec/internal/forward"
+	"github.com/brian14708/rexec/internal/protocol"
+	"github.com/brian14708/rexec/internal/sshconn"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/xtaci/smux"
+)
+
+// handleForward relays every stream the client opens to the address it
+// names, dialed through the server's SSH connection.
+func (d *daemon) handleForward(session *smux.Session, cmd *protocol.CommandChan, req *protocol.ForwardRequest) {
+	p, err := d.profile(req.Profile)
+	if err != nil {
+		sendError(cmd, err)
+		return
+	}
+	if req.Server == protocol.AutoServer || (req.Server == "" && p.Server == protocol.AutoServer) {
+		sendError(cmd, errors.New("port forwarding needs a fixed server, not auto"))
+		return
+	}
+	srv, err := d.resolveServer(req.Server, p, nil)
+	if err != nil {
+		sendError(cmd, err)
+		return
+	}
+
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		go d.forwardStream(srv, stream)
+	}
+}
+
+func (d *daemon) forwardStream(srv *server, stream *smux.Stream) {
+	c := protocol.NewCommandChan(stream)
+	req, err := c.RecvRequest()
+	if err != nil || req.Dial == nil {
+		logrus.Warnf("invalid forward stream: %v", err)
+		c.Close()
+		return
+	}
+
+	conn, err := srv.Conn()
+	if err != nil {
+		logrus.Warnf("cannot forward to %s: %v", req.Dial.Address, err)
+		c.Close()
+		return
+	}
+	nc, err := conn.Dial(req.Dial.Network, req.Dial.Address)
+	if err != nil {
+		logrus.Warnf("failed to dial %s on %s: %v", req.Dial.Address, srv.name, err)
+		c.Close()
+		return
+	}
+	defer srv.use()()
+	forward.Pipe(c, nc)
+}
+
+// listenRemote opens the remote listeners of an exec request, connections
+// are tunneled back to the client over session.
+func listenRemote(conn *sshconn.Conn, session *smux.Session, fwds []protocol.RemoteForward) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, f := range fwds {
+		ln, err := conn.Listen("tcp", f.Listen)
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return nil, errors.Wrapf(err, "cannot listen on %s", f.Listen)
+		}
+		listeners = append(listeners, ln)
+		go reverseForward(ln, session, f.Connect)
+	}
+	return listeners, nil
+}
+
+func reverseForward(ln net.Listener, session *smux.Session, addr string) {
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			stream, err := session.OpenStream()
+			if err != nil {
+				logrus.Warnf("cannot forward connection to %s: %v", addr, err)
+				nc.Close()
+				return
+			}
+			c := protocol.NewCommandChan(stream)
+			err = c.SendRequest(&protocol.Request{
+				Dial: &protocol.DialRequest{
+					Network: "tcp",
+					Address: addr,
+				},
+			})
+			if err != nil {
+				c.Close()
+				nc.Close()
+				return
+			}
+			forward.Pipe(nc, c)
+		}()
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/brian14708/rexec/internal/asciicast"
+	"github.com/brian14708/rexec/internal/protocol"
+	"github.com/brian14708/rexec/internal/sandbox"
+	"github.com/brian14708/rexec/internal/sshconn"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// how long a finished job is kept around when nobody collected its exit
+	// status
+	jobRetention = time.Hour
+
+	// number of SIGINT forwarded before escalating to SIGKILL
+	killAfterInterrupts = 3
+
+	// time between SIGTERM and SIGKILL when a job times out
+	timeoutGrace = 10 * time.Second
+)
+
+type job struct {
+	id       string
+	server   string
+	command  string
+	args     []string
+	started  time.Time
+	detached bool
+	pty      bool
+	client   string
+
+	cmd    *sshconn.Cmd
+	conn   *sshconn.Conn
+	spec   *sandbox.Spec
+	stdin  io.WriteCloser
+	output *outputBuffer
+	flush  []io.Closer
+	done   chan struct{}
+	// remote forwarded ports, open while the command runs
+	listeners []net.Listener
+	record    *asciicast.Writer
+	// systemd scope of a job with limits
+	scope string
+	// limits approximated by rlimits for lack of a scope
+	approximated []string
+	// working directory copy in sync mode
+	sync *syncedDir
+	// keeps the server connected while the job runs
+	release func()
+
+	mu         sync.Mutex
+	status     *protocol.ExitStatus
+	interrupts int
+	clients    int
+	active     time.Time
+	timedOut   string
+	// set when a timed out job had to be killed
+	killed bool
+}
+
+func (j *job) Info() protocol.JobInfo {
+	return protocol.JobInfo{
+		ID:       j.id,
+		Server:   j.server,
+		Command:  j.command,
+		Args:     j.args,
+		Started:  j.started,
+		Detached: j.detached,
+		PTY:      j.pty,
+		PID:      j.cmd.PID(),
+		Client:   j.client,
+		Clients:  j.Clients(),
+		Exit:     j.Status(),
+	}
+}
+
+func (j *job) Clients() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.clients
+}
+
+func (j *job) addClient(n int) {
+	j.mu.Lock()
+	j.clients += n
+	j.mu.Unlock()
+}
+
+func (j *job) Status() *protocol.ExitStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+// Signal delivers a signal to the command in the sandbox. It is sent from
+// a second session since bwrap, which the session of the job runs, does not
+// forward signals. SIGKILL goes to bwrap, which kills the sandbox with it.
+func (j *job) Signal(name string) error {
+	sig := ssh.Signal(name)
+	if sig == ssh.SIGINT {
+		j.mu.Lock()
+		j.interrupts++
+		if j.interrupts >= killAfterInterrupts {
+			logrus.Warnf("job %s received %d interrupts, killing process", j.id, j.interrupts)
+			sig = ssh.SIGKILL
+		}
+		j.mu.Unlock()
+	}
+	if sig == ssh.SIGKILL {
+		return j.cmd.Signal(sig)
+	}
+	return runRemote(j.conn, j.spec.SignalArgs(string(sig)))
+}
+
+func (j *job) wait() {
+	status := exitStatus(j.cmd.Wait())
+	j.closeListeners()
+	runRemote(j.conn, []string{"rm", "-f", j.spec.InfoFile})
+	if j.sync != nil {
+		if err := j.sync.pullOutputs(); err != nil {
+			logrus.Warnf("failed to copy outputs of job %s: %v", j.id, err)
+		}
+	}
+	// the OOM killer may hit bwrap or a process below it, which bwrap only
+	// reports as exit status
+	if j.scope != "" && (status.ExitCode != 0 || status.Signal != "") {
+		status.Limit = scopeLimit(j.conn, j.scope)
+	}
+	status.ApproximatedLimits = j.approximated
+	// the CPU time rlimit standing in for the cpu limit, bwrap reports a
+	// command killed by SIGXCPU as 128+24
+	if len(j.approximated) > 0 && (status.Signal == "XCPU" || status.ExitCode == 128+24) {
+		status.Limit = "cpu"
+	}
+	if status.Limit != "" {
+		logrus.Infof("job %s exceeded its %s limit", j.id, status.Limit)
+	}
+
+	j.mu.Lock()
+	if j.timedOut != "" {
+		status.Timeout = j.timedOut
+		status.Killed = j.killed
+		status.ExitCode = 124
+	}
+	j.status = status
+	j.mu.Unlock()
+	for _, f := range j.flush {
+		f.Close()
+	}
+	if j.record != nil {
+		if err := j.record.Close(); err != nil {
+			logrus.Warnf("failed to record job %s: %v", j.id, err)
+		}
+	}
+	j.output.Close()
+	j.release()
+	close(j.done)
+}
+
+// touch marks the job as active for the idle timeout.
+func (j *job) touch() {
+	j.mu.Lock()
+	j.active = time.Now()
+	j.mu.Unlock()
+}
+
+// enforceTimeouts terminates the job once it ran for longer than timeout or
+// had no input or output for longer than idle, zero disables either.
+func (j *job) enforceTimeouts(timeout, idle time.Duration) {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		deadline = t.C
+	}
+	var check <-chan time.Time
+	if idle > 0 {
+		interval := idle / 10
+		if interval > time.Second {
+			interval = time.Second
+		}
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		check = t.C
+	}
+
+	for {
+		select {
+		case <-j.done:
+			return
+		case <-deadline:
+			j.expire(protocol.TimeoutTotal)
+			return
+		case <-check:
+			j.mu.Lock()
+			active := j.active
+			j.mu.Unlock()
+			if time.Since(active) >= idle {
+				j.expire(protocol.TimeoutIdle)
+				return
+			}
+		}
+	}
+}
+
+func (j *job) expire(reason string) {
+	j.mu.Lock()
+	j.timedOut = reason
+	j.mu.Unlock()
+
+	logrus.Infof("job %s reached its %s, terminating", j.id, reason)
+	if err := j.Signal(string(ssh.SIGTERM)); err != nil {
+		logrus.Warnf("failed to terminate job %s, killing it: %v", j.id, err)
+	} else {
+		select {
+		case <-j.done:
+			return
+		case <-time.After(timeoutGrace):
+			logrus.Warnf("job %s did not exit within %s, killing it", j.id, timeoutGrace)
+		}
+	}
+	j.mu.Lock()
+	j.killed = true
+	j.mu.Unlock()
+	j.cmd.Signal(ssh.SIGKILL)
+}
+
+type touchWriter struct {
+	w io.Writer
+	j *job
+}
+
+func (t touchWriter) Write(p []byte) (int, error) {
+	t.j.touch()
+	return t.w.Write(p)
+}
+
+// recorded returns the writer for an output stream, including the recording
+// if there is one.
+func (j *job) recorded(stream int) io.Writer {
+	w := io.Writer(touchWriter{j.output.Writer(stream), j})
+	if j.record == nil {
+		return w
+	}
+	typ := asciicast.EventOutput
+	if stream == streamStderr {
+		typ = asciicast.EventError
+	}
+	return io.MultiWriter(w, j.record.Stream(typ))
+}
+
+func (j *job) closeListeners() {
+	for _, ln := range j.listeners {
+		ln.Close()
+	}
+}
+
+func exitStatus(err error) *protocol.ExitStatus {
+	status := &protocol.ExitStatus{
+		Category: protocol.ErrorRemoteExit,
+	}
+	switch e := err.(type) {
+	case nil:
+	case *sshconn.ExitError:
+		status.ExitCode = e.Status
+		status.Signal = e.Signal
+		status.CoreDumped = e.CoreDumped
+		status.Error = e.Msg
+	default:
+		status.ExitCode = 255
+		status.Error = err.Error()
+		status.Category = protocol.ErrorConnect
+	}
+	return status
+}
+
+type jobTable struct {
+	mu   sync.Mutex
+	next int
+	jobs map[string]*job
+}
+
+func newJobTable() *jobTable {
+	return &jobTable{
+		jobs: map[string]*job{},
+	}
+}
+
+func (t *jobTable) Add(j *job) {
+	t.mu.Lock()
+	t.next++
+	j.id = strconv.Itoa(t.next)
+	t.jobs[j.id] = j
+	t.mu.Unlock()
+
+	go func() {
+		<-j.done
+		time.AfterFunc(jobRetention, func() {
+			t.Remove(j.id)
+		})
+	}()
+}
+
+func (t *jobTable) Get(id string) *job {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.jobs[id]
+}
+
+// Latest returns the most recently started job that is still running and
+// has no client attached.
+func (t *jobTable) Latest() *job {
+	jobs := t.List()
+	for i := len(jobs) - 1; i >= 0; i-- {
+		j := jobs[i]
+		if j.Status() == nil && j.Clients() == 0 {
+			return j
+		}
+	}
+	return nil
+}
+
+func (t *jobTable) Remove(id string) {
+	t.mu.Lock()
+	delete(t.jobs, id)
+	t.mu.Unlock()
+}
+
+func (t *jobTable) List() []*job {
+	t.mu.Lock()
+	jobs := make([]*job, 0, len(t.jobs))
+	for _, j := range t.jobs {
+		jobs = append(jobs, j)
+	}
+	t.mu.Unlock()
+
+	sort.Slice(jobs, func(i, k int) bool {
+		a, _ := strconv.Atoi(jobs[i].id)
+		b, _ := strconv.Atoi(jobs[k].id)
+		return a < b
+	})
+	return jobs
+}
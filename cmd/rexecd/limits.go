@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+
+	"github.com/brian14708/rexec/internal/sandbox"
+	"github.com/brian14708/rexec/internal/sshconn"
+	"github.com/pkg/errors"
+)
+
+// scopeName returns a unique name for the systemd scope of a job.
+func scopeName() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "rexec-" + hex.EncodeToString(b), nil
+}
+
+// checkScope fails if the server cannot create a systemd user scope that
+// enforces l, either since there is no systemd user session or since the
+// user manager lacks one of the cgroup controllers l needs.
+func checkScope(conn *sshconn.Conn, l sandbox.Limits) error {
+	cc, err := conn.RunCommand(context.TODO(), sandbox.ScopeCheck[0], sandbox.ScopeCheck[1:]...)
+	if err != nil {
+		return err
+	}
+	var out, errOut bytes.Buffer
+	cc.Stdout = &out
+	cc.Stderr = &errOut
+	if err := cc.Start(); err != nil {
+		return err
+	}
+	if err := cc.Wait(); err != nil {
+		msg := strings.TrimSpace(errOut.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return errors.Errorf("no systemd user scope: %s", msg)
+	}
+
+	delegated := map[string]bool{}
+	for _, c := range strings.Fields(out.String()) {
+		delegated[c] = true
+	}
+	var missing []string
+	for _, c := range l.Controllers() {
+		if !delegated[c] {
+			missing = append(missing, c)
+		}
+	}
+	if len(missing) > 0 {
+		return errors.Errorf("cgroup controllers not delegated to the systemd user manager: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// scopeLimit asks systemd why the scope of a killed job stopped and returns
+// the limit that was hit, empty if none or no scope was used. Failed scopes
+// are kept by systemd until they are reset.
+func scopeLimit(conn *sshconn.Conn, scope string) string {
+	unit := scope + ".scope"
+	cc, err := conn.RunCommand(context.TODO(), "sh", "-c",
+		`systemctl --user show -p Result --value "$1" && systemctl --user reset-failed "$1"`, "sh", unit)
+	if err != nil {
+		return ""
+	}
+	var out bytes.Buffer
+	cc.Stdout = &out
+	if err := cc.Start(); err != nil {
+		return ""
+	}
+	cc.Wait()
+
+	switch strings.TrimSpace(strings.SplitN(out.String(), "\n", 2)[0]) {
+	case "oom-kill":
+		return "memory"
+	}
+	return ""
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brian14708/rexec/internal/protocol"
+	"github.com/brian14708/rexec/internal/sshconn"
+	"github.com/pkg/errors"
+)
+
+// default time between load samples of a server
+const defaultLoadInterval = 30 * time.Second
+
+// sampleLoad records the load of the server every interval, and whenever
+// the supervisor asks for it, until it is closed.
+func (s *server) sampleLoad(interval time.Duration) {
+	for {
+		var load *protocol.ServerLoad
+		if conn, err := s.connected(); err == nil {
+			load, _ = readLoad(conn)
+		}
+		s.mu.Lock()
+		s.load = load
+		s.mu.Unlock()
+
+		select {
+		case <-s.closed:
+			return
+		case <-s.sample:
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (s *server) sleeping() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.asleep
+}
+
+func (s *server) Load() *protocol.ServerLoad {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.load
+}
+
+func readLoad(conn *sshconn.Conn) (*protocol.ServerLoad, error) {
+	cc, err := conn.RunCommandRaw(context.TODO(), "cat /proc/loadavg && nproc && grep MemAvailable /proc/meminfo")
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	cc.Stdout = &out
+	if err := cc.Start(); err != nil {
+		return nil, err
+	}
+	if err := cc.Wait(); err != nil {
+		return nil, err
+	}
+
+	lines := strings.Split(out.String(), "\n")
+	if len(lines) < 3 {
+		return nil, errors.New("unexpected load output")
+	}
+	load := &protocol.ServerLoad{
+		Sampled: time.Now(),
+	}
+	if f := strings.Fields(lines[0]); len(f) > 0 {
+		load.Load1, err = strconv.ParseFloat(f[0], 64)
+	}
+	if err == nil {
+		load.CPUs, err = strconv.Atoi(strings.TrimSpace(lines[1]))
+	}
+	if f := strings.Fields(lines[2]); err == nil && len(f) >= 2 {
+		var kb int64
+		kb, err = strconv.ParseInt(f[1], 10, 64)
+		load.MemAvailable = kb * 1024
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "unexpected load output")
+	}
+	return load, nil
+}
+
+// pickServer returns the connected server matching labels with the lowest
+// load per CPU, counting running jobs as load. Ties go to the server with
+// more available memory. Connected servers without a load sample yet are
+// picked when no sampled server matches, sleeping lazy servers only when no
+// connected server matches.
+func (d *daemon) pickServer(labels map[string]string) (*server, error) {
+	sessions := make(map[string]int)
+	for _, j := range d.jobs.List() {
+		if j.Status() == nil {
+			sessions[j.server]++
+		}
+	}
+
+	_, servers := d.current()
+	names := make([]string, 0, len(servers))
+	for name := range servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var best, unknown, sleeping *server
+	var bestScore float64
+	var bestMem int64
+	for _, name := range names {
+		srv := servers[name]
+		if !matchLabels(srv.config().Labels, labels) {
+			continue
+		}
+		if _, err := srv.connected(); err != nil {
+			if sleeping == nil && srv.sleeping() {
+				sleeping = srv
+			}
+			continue
+		}
+		load := srv.Load()
+		if load == nil {
+			if unknown == nil {
+				unknown = srv
+			}
+			continue
+		}
+		cpus := load.CPUs
+		if cpus < 1 {
+			cpus = 1
+		}
+		score := (load.Load1 + float64(sessions[name])) / float64(cpus)
+		if best == nil || score < bestScore || (score == bestScore && load.MemAvailable > bestMem) {
+			best, bestScore, bestMem = srv, score, load.MemAvailable
+		}
+	}
+	if best == nil {
+		best = unknown
+	}
+	if best == nil {
+		best = sleeping
+	}
+	if best == nil {
+		return nil, &execError{protocol.ErrorConnect, errors.New("no server available matching the labels")}
+	}
+	return best, nil
+}
+
+func matchLabels(have, want map[string]string) bool {
+	for k, v := range want {
+		if have[k] != v {
+			return false
+		}
+	}
+	return true
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"context"
 	"flag"
 	"fmt"
 	"net"
@@ -9,15 +8,15 @@ import (
 	"os/signal"
 	"path/filepath"
 	"syscall"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/brian14708/rexec/internal/cmdutil"
+	"github.com/brian14708/rexec/internal/pathmap"
 	"github.com/brian14708/rexec/internal/protocol"
 	"github.com/brian14708/rexec/internal/sandbox"
-	"github.com/brian14708/rexec/internal/sshconn"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
-	"github.com/xtaci/smux"
-	"golang.org/x/crypto/ssh"
 )
 
 var (
@@ -27,17 +26,138 @@ var (
 
 type Config struct {
 	Environment struct {
-		Bind []struct {
-			Path   string
-			Source string
-			Mode   sandbox.BindType
+		Bind []BindConfig
+	}
+	DefaultServer string
+	// bytes of output kept per job for attach and logs
+	Scrollback int
+	Env        EnvConfig
+	PathMap    []pathmap.Rule
+	Limits     sandbox.Limits
+	// time between load samples for -H auto
+	LoadInterval cmdutil.Duration
+	Servers      map[string]ServerConfig
+	Profiles     map[string]ProfileConfig
+}
+
+// BindConfig mounts Source, defaulting to Path, at Path inside a sandbox.
+type BindConfig struct {
+	Path   string
+	Source string
+	Mode   sandbox.BindType
+}
+
+func (b BindConfig) spec() sandbox.BindSpec {
+	src := b.Source
+	if src == "" {
+		src = b.Path
+	}
+	return sandbox.BindSpec{
+		Dst:  b.Path,
+		Src:  src,
+		Type: b.Mode,
+	}
+}
+
+// ProfileConfig is a named set of settings selected with "rexec @name",
+// the client applies Shell and PTY.
+type ProfileConfig struct {
+	// used when the request names no server
+	Server string
+	// set after the server's variables
+	Env         map[string]string
+	Bind        []BindConfig
+	Timeout     cmdutil.Duration
+	IdleTimeout cmdutil.Duration
+	// replaces the path mapping of the server
+	PathMap []pathmap.Rule
+}
+
+type ServerConfig struct {
+	Host    string
+	Port    int
+	User    string
+	Env     EnvConfig
+	PathMap []pathmap.Rule
+	// directory to record every job to in asciicast format, relative to the
+	// config directory
+	Record string
+	// defaults for requests without timeouts, zero means none
+	Timeout     cmdutil.Duration
+	IdleTimeout cmdutil.Duration
+	// fields set override the global limits
+	Limits sandbox.Limits
+	Sync   SyncConfig
+	// extra binds of the remote sandbox, Source is a path on the server
+	Bind []BindConfig
+	// matched by the -l constraints of -H auto
+	Labels map[string]string
+	// interval of keepalive requests, the connection is considered lost
+	// when one is not answered within the same time
+	Keepalive cmdutil.Duration
+	// connect on the first request for the server instead of at startup
+	Lazy bool
+	// disconnect after the server was not used for this long
+	IdleDisconnect cmdutil.Duration
+}
+
+// SyncConfig runs commands in a copy of the working directory on the server
+// instead of on the sshfs mount. There is one copy per working directory,
+// concurrent jobs in the same directory share it and see each other's
+// changes, outputs copied back may come from any of them.
+type SyncConfig struct {
+	Enabled bool
+	// remote directory of the copies, relative to the home directory,
+	// defaults to ~/.cache/rexec/sync
+	CacheDir string
+	// glob patterns of files not to copy
+	Exclude []string
+	// paths relative to the working directory copied back after the
+	// command exits
+	Outputs []string
+}
+
+// EnvConfig controls which client variables are forwarded, Allow and Deny
+// are glob patterns on the variable name, Set overrides variables.
+// NoDefaultDeny stops dropping the local-only variables of
+// envpolicy.DefaultDeny that are not allowed explicitly.
+type EnvConfig struct {
+	Allow         []string
+	Deny          []string
+	Set           map[string]string
+	NoDefaultDeny bool
+}
+
+func (c *Config) Validate() error {
+	if _, err := pathmap.New(c.PathMap); err != nil {
+		return err
+	}
+	for name, srv := range c.Servers {
+		if _, err := pathmap.New(srv.PathMap); err != nil {
+			return errors.Wrapf(err, "server %s", name)
+		}
+	}
+	for name, p := range c.Profiles {
+		if _, err := pathmap.New(p.PathMap); err != nil {
+			return errors.Wrapf(err, "profile %s", name)
+		}
+		if _, ok := c.Servers[p.Server]; p.Server != "" && p.Server != protocol.AutoServer && !ok {
+			return errors.Errorf("profile %s: unknown server %s", name, p.Server)
 		}
 	}
-	Servers map[string]struct {
-		Host string
-		Port int
-		User string
+	return nil
+}
+
+func loadConfig(configDir string) (Config, error) {
+	var config Config
+	_, err := toml.DecodeFile(filepath.Join(configDir, "config.toml"), &config)
+	if err != nil {
+		return config, errors.Wrap(err, "cannot parse config file")
+	}
+	if err := config.Validate(); err != nil {
+		return config, errors.Wrap(err, "invalid config")
 	}
+	return config, nil
 }
 
 func main() {
@@ -49,10 +169,9 @@ func main() {
 	}
 	fmt.Println(configDir)
 
-	var config Config
-	_, err := toml.DecodeFile(filepath.Join(configDir, "config.toml"), &config)
+	config, err := loadConfig(configDir)
 	if err != nil {
-		logrus.Fatalf("cannot find parse config file: %v", err)
+		logrus.Fatalf("%v", err)
 	}
 
 	if !*flagNoSandbox {
@@ -60,35 +179,13 @@ func main() {
 		return
 	}
 
-	conns := map[string]*sshconn.Conn{}
-	for name, server := range config.Servers {
-		port := ""
-		if server.Port != 0 {
-			port = fmt.Sprintf("%d", server.Port)
-		}
-		conn, err := sshconn.New(sshconn.Config{
-			Host: server.Host,
-			Port: port,
-			User: server.User,
-
-			KnownHostsFile: filepath.Join(configDir, "known_hosts"),
-		})
-		if err != nil {
-			logrus.Warnf("failed to connect to %s: %v", name, err)
-		}
-		conns[name] = conn
-		conn.RemoteMount(context.TODO(), "/", fmt.Sprintf("/tmp/rexec-%s-%s", "hostname", name), "-o kernel_cache -o auto_cache -o negative_timeout=5 -o entry_timeout=5 -o attr_timeout=5 -o max_readahead=90000")
-		// TODO check error
-	}
-
 	sockPath := filepath.Join(configDir, "daemon.sock")
 	lockPath := filepath.Join(configDir, "daemon.sock.lock")
 	lock, err := os.OpenFile(lockPath, os.O_RDONLY|os.O_CREATE, 0600)
 	if err != nil {
 		logrus.Fatalf("cannot create lock file: %v", err)
 	}
-	err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
-	if err != nil {
+	if err := lockDaemon(lock); err != nil {
 		logrus.Fatal("another daemon instance is running")
 	}
 	defer func() {
@@ -96,6 +193,18 @@ func main() {
 		lock.Close()
 		os.Remove(lockPath)
 	}()
+	// connect while holding the lock, so clients can tell that the daemon
+	// is starting up
+	d := &daemon{
+		started:   time.Now(),
+		configDir: configDir,
+		config:    config,
+		servers:   connectServers(configDir, config, 0),
+		jobs:      newJobTable(),
+		loaded:    time.Now(),
+	}
+	go d.watchConfig()
+
 	if err := os.Remove(sockPath); err != nil {
 		if !os.IsNotExist(err) {
 			logrus.Fatalf("cannot remove socket: %v", err)
@@ -121,152 +230,16 @@ func main() {
 			logrus.Warnf("accept error: %v", err)
 			break
 		}
-		go handleConnection(conn, conns["local"])
+		go d.handleConnection(conn)
 	}
 
-	for _, conn := range conns {
-		conn.Close()
+	_, servers := d.current()
+	for _, srv := range servers {
+		srv.Close()
 	}
 	os.Exit(9)
 }
 
-func handleConnection(c net.Conn, conn *sshconn.Conn) {
-	defer c.Close()
-
-	// Setup server side of smux
-	session, err := smux.Server(c, nil)
-	if err != nil {
-		panic(err)
-	}
-	defer session.Close()
-
-	// Accept a stream
-	stream, err := session.AcceptStream()
-	if err != nil {
-		panic(err)
-	}
-	cmd := protocol.NewCommandChan(stream)
-	defer cmd.Close()
-
-	req, err := cmd.RecvRequest()
-	if err != nil {
-		logrus.Warnf("invalid request format: %v", err)
-		return
-	}
-	fmt.Println(req)
-
-	inStream, err := session.AcceptStream()
-	if err != nil {
-		panic(err)
-	}
-
-	outStream, err := session.AcceptStream()
-	if err != nil {
-		panic(err)
-	}
-
-	errStream, err := session.AcceptStream()
-	if err != nil {
-		panic(err)
-	}
-
-	s := &sandbox.Spec{
-		Command:    req.Exec.Command,
-		Args:       req.Exec.Args,
-		WorkingDir: req.Exec.WorkingDir,
-		Env: append(req.Exec.Env,
-			"REXEC=1",
-		),
-		Bind: []sandbox.BindSpec{
-			sandbox.BindSpec{
-				Dst:  "/",
-				Src:  "/tmp/rexec-hostname-local",
-				Type: sandbox.BindReadWrite,
-			},
-			sandbox.BindSpec{
-				Dst:  "/etc/resolv.conf",
-				Src:  "/etc/resolv.conf",
-				Type: sandbox.BindReadOnly,
-			},
-			sandbox.BindSpec{
-				Dst:  "/sys",
-				Src:  "/sys",
-				Type: sandbox.BindReadOnly,
-			},
-			sandbox.BindSpec{
-				Dst:  "/run",
-				Type: sandbox.BindTmpFS,
-			},
-			sandbox.BindSpec{
-				Dst:  "/tmp",
-				Type: sandbox.BindTmpFS,
-			},
-			sandbox.BindSpec{
-				Dst:  "/dev",
-				Type: sandbox.BindDevFS,
-			},
-			sandbox.BindSpec{
-				Dst:  "/proc",
-				Type: sandbox.BindProcFS,
-			},
-		},
-		UnshareNamespace: true,
-	}
-
-	var cc *sshconn.Cmd
-	if !req.Exec.DisablePTY {
-		modes := ssh.TerminalModes{
-			ssh.TTY_OP_ISPEED: 115200,
-			ssh.TTY_OP_OSPEED: 115200,
-		}
-
-		args := s.CommandArgs()
-		cc, _ = conn.RunCommand(context.TODO(), args[0], args[1:]...)
-		cc.Stdout = outStream
-		cc.Stderr = errStream
-		cc.Stdin = inStream
-
-		err = cc.StartPTY(req.Exec.TerminalName, req.Exec.TerminalLines, req.Exec.TerminalCols, modes)
-
-	} else {
-		args := s.CommandArgs()
-		cc, err = conn.RunCommand(context.TODO(), args[0], args[1:]...)
-		if err != nil {
-			panic(err)
-		}
-		cc.Stdout = outStream
-		cc.Stderr = errStream
-		cc.Stdin = inStream
-
-		err = cc.Start()
-	}
-
-	go func() {
-		for req := range cmd.RecvNotification() {
-			if wc := req.WindowChange; wc != nil {
-				cc.WindowChange(wc.TerminalLines, wc.TerminalCols)
-			}
-		}
-	}()
-	err = cc.Wait()
-	outStream.Close()
-	errStream.Close()
-
-	exitCode := 0
-	if err != nil {
-		exitCode = 255
-		if e, ok := err.(*ssh.ExitError); ok {
-			exitCode = e.Waitmsg.ExitStatus()
-		}
-	}
-
-	cmd.SendNotification(&protocol.Notification{
-		Exit: &protocol.ExitStatus{
-			ExitCode: exitCode,
-		},
-	})
-}
-
 func ensureConfigDir() (string, error) {
 	dir, err := os.UserConfigDir()
 	if err != nil {
@@ -282,3 +255,16 @@ func ensureConfigDir() (string, error) {
 	}
 	return path, nil
 }
+
+// lockDaemon takes the exclusive daemon lock. Clients probe the lock with a
+// short shared lock, which is retried for a while before giving up.
+func lockDaemon(lock *os.File) error {
+	deadline := time.Now().Add(time.Second)
+	for {
+		err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err != syscall.EWOULDBLOCK || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// localName identifies this machine and user on the servers, so clients
+// sharing a server get their own mountpoints.
+func localName(configDir string) string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	username := strconv.Itoa(os.Getuid())
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+	id := machineID(configDir)
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	return fmt.Sprintf("%s-%s-%s", pathSafe(hostname), pathSafe(username), id)
+}
+
+// mountPoint is where the local root is mounted on a server. Servers
+// reconnected by a config reload get the generation of the reload as
+// suffix, so they do not race with the mount of the retired instance.
+func mountPoint(local, server string, generation int) string {
+	mnt := fmt.Sprintf("/tmp/rexec-%s-%s", local, pathSafe(server))
+	if generation > 0 {
+		mnt += fmt.Sprintf("-%d", generation)
+	}
+	return mnt
+}
+
+// machineID returns /etc/machine-id, or an ID generated once and kept in the
+// config dir on systems without one.
+func machineID(configDir string) string {
+	if b, err := ioutil.ReadFile("/etc/machine-id"); err == nil {
+		if id := strings.TrimSpace(string(b)); id != "" {
+			return id
+		}
+	}
+
+	idPath := filepath.Join(configDir, "machine-id")
+	if b, err := ioutil.ReadFile(idPath); err == nil {
+		if id := strings.TrimSpace(string(b)); id != "" {
+			return id
+		}
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		logrus.Fatalf("cannot generate machine ID: %v", err)
+	}
+	id := hex.EncodeToString(b)
+	if err := ioutil.WriteFile(idPath, []byte(id+"\n"), 0600); err != nil {
+		logrus.Warnf("cannot save machine ID: %v", err)
+	}
+	return id
+}
+
+// pathSafe replaces characters that do not belong in a file name.
+func pathSafe(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9',
+			r == '.', r == '_', r == '-':
+			return r
+		}
+		return '_'
+	}, s)
+}
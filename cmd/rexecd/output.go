@@ -0,0 +1,206 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+const (
+	streamStdout = 1
+	streamStderr = 2
+
+	// default number of output bytes kept per job
+	defaultScrollback = 1 << 20
+)
+
+type outputChunk struct {
+	stream int
+	data   []byte
+}
+
+// outputBuffer is a bounded ring of the output written by a job. It keeps
+// the most recent limit bytes as scrollback and lets any number of readers
+// follow it. Output is never dropped before every follower read it, writes
+// block instead, which holds back the remote process.
+type outputBuffer struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	chunks    []outputChunk
+	first     int // position of chunks[0]
+	size      int
+	limit     int
+	closed    bool
+	followers map[*follower]struct{}
+}
+
+// follower is the position of a reader following the buffer.
+type follower struct {
+	pos int
+}
+
+func newOutputBuffer(limit int) *outputBuffer {
+	if limit <= 0 {
+		limit = defaultScrollback
+	}
+	b := &outputBuffer{
+		limit:     limit,
+		followers: make(map[*follower]struct{}),
+	}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *outputBuffer) Writer(stream int) io.Writer {
+	return &outputWriter{b, stream}
+}
+
+func (b *outputBuffer) write(stream int, p []byte) {
+	b.mu.Lock()
+	if len(p) > b.limit && len(b.followers) == 0 {
+		p = p[len(p)-b.limit:]
+	}
+	data := make([]byte, len(p))
+	copy(data, p)
+
+	b.chunks = append(b.chunks, outputChunk{stream, data})
+	b.size += len(data)
+	b.cond.Broadcast()
+	for b.size > b.limit {
+		if b.pinned() {
+			// wait for followers to read the oldest chunk
+			b.cond.Wait()
+			continue
+		}
+		b.size -= len(b.chunks[0].data)
+		b.chunks[0] = outputChunk{}
+		b.chunks = b.chunks[1:]
+		b.first++
+	}
+	b.mu.Unlock()
+}
+
+// pinned reports whether a follower has not read the oldest chunk yet.
+func (b *outputBuffer) pinned() bool {
+	for f := range b.followers {
+		if f.pos <= b.first {
+			return true
+		}
+	}
+	return false
+}
+
+// Follow registers a reader starting at pos, or the oldest buffered output
+// if it already dropped out. It has to be released with Unfollow.
+func (b *outputBuffer) Follow(pos int) *follower {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if pos < b.first {
+		pos = b.first
+	}
+	f := &follower{pos}
+	b.followers[f] = struct{}{}
+	return f
+}
+
+func (b *outputBuffer) Unfollow(f *follower) {
+	b.mu.Lock()
+	delete(b.followers, f)
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// Next blocks until there is output after the position of f and returns it,
+// an empty result means the buffer is drained and closed.
+func (b *outputBuffer) Next(f *follower) []outputChunk {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for f.pos >= b.first+len(b.chunks) && !b.closed {
+		b.cond.Wait()
+	}
+	end := b.first + len(b.chunks)
+	if f.pos >= end {
+		return nil
+	}
+	chunks := make([]outputChunk, end-f.pos)
+	copy(chunks, b.chunks[f.pos-b.first:])
+	return chunks
+}
+
+// advance moves f past chunks returned by Next once they were delivered,
+// releasing them for eviction.
+func (b *outputBuffer) advance(f *follower, n int) {
+	b.mu.Lock()
+	f.pos += n
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+func (b *outputBuffer) Close() {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// Read returns the buffered chunks after pos and the position to continue
+// from, output that already dropped out of the ring is skipped.
+func (b *outputBuffer) Read(pos int) ([]outputChunk, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if pos < b.first {
+		pos = b.first
+	}
+	end := b.first + len(b.chunks)
+	if pos >= end {
+		return nil, pos
+	}
+	chunks := make([]outputChunk, end-pos)
+	copy(chunks, b.chunks[pos-b.first:])
+	return chunks, end
+}
+
+type outputWriter struct {
+	b      *outputBuffer
+	stream int
+}
+
+func (w *outputWriter) Write(p []byte) (int, error) {
+	w.b.write(w.stream, p)
+	return len(p), nil
+}
+
+// copyOutput writes the buffered output starting at pos to stdout and
+// stderr, following new output until the buffer is closed if follow is set.
+// A follower holds back the job while it does not keep up.
+func copyOutput(b *outputBuffer, pos int, follow bool, stdout, stderr io.Writer) error {
+	if !follow {
+		chunks, _ := b.Read(pos)
+		return writeChunks(chunks, stdout, stderr)
+	}
+
+	f := b.Follow(pos)
+	defer b.Unfollow(f)
+	for {
+		chunks := b.Next(f)
+		if len(chunks) == 0 {
+			return nil
+		}
+		if err := writeChunks(chunks, stdout, stderr); err != nil {
+			return err
+		}
+		b.advance(f, len(chunks))
+	}
+}
+
+func writeChunks(chunks []outputChunk, stdout, stderr io.Writer) error {
+	for _, c := range chunks {
+		w := stdout
+		if c.stream == streamStderr {
+			w = stderr
+		}
+		if _, err := w.Write(c.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
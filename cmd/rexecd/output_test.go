@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestOutputBufferScrollback(t *testing.T) {
+	tests := []struct {
+		name   string
+		limit  int
+		writes []string
+		pos    int
+		stdout string
+		next   int
+	}{
+		{"empty", 8, nil, 0, "", 0},
+		{"within limit", 8, []string{"ab", "cd"}, 0, "abcd", 2},
+		{"from position", 8, []string{"ab", "cd"}, 1, "cd", 2},
+		{"past end", 8, []string{"ab"}, 5, "", 5},
+		{"oldest dropped", 4, []string{"ab", "cd", "ef"}, 0, "cdef", 3},
+		{"large write keeps tail", 4, []string{"abcdefgh"}, 0, "efgh", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newOutputBuffer(tt.limit)
+			for _, w := range tt.writes {
+				b.write(streamStdout, []byte(w))
+			}
+			chunks, next := b.Read(tt.pos)
+			var out bytes.Buffer
+			if err := writeChunks(chunks, &out, &out); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.stdout || next != tt.next {
+				t.Errorf("Read(%d) = %q, %d; want %q, %d", tt.pos, out.String(), next, tt.stdout, tt.next)
+			}
+		})
+	}
+}
+
+func TestCopyOutputStreams(t *testing.T) {
+	b := newOutputBuffer(16)
+	b.Writer(streamStdout).Write([]byte("out1 "))
+	b.Writer(streamStderr).Write([]byte("err "))
+	b.Writer(streamStdout).Write([]byte("out2"))
+	b.Close()
+
+	for _, follow := range []bool{false, true} {
+		var stdout, stderr bytes.Buffer
+		if err := copyOutput(b, 0, follow, &stdout, &stderr); err != nil {
+			t.Fatal(err)
+		}
+		if stdout.String() != "out1 out2" || stderr.String() != "err " {
+			t.Errorf("follow=%v: stdout %q, stderr %q", follow, stdout.String(), stderr.String())
+		}
+	}
+}
+
+// slowWriter blocks every write until it is released.
+type slowWriter struct {
+	release chan struct{}
+	buf     bytes.Buffer
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return w.buf.Write(p)
+}
+
+func TestOutputBufferFollowerBackpressure(t *testing.T) {
+	b := newOutputBuffer(4)
+	w := &slowWriter{release: make(chan struct{})}
+	copied := make(chan error)
+	f := b.Follow(0)
+	go func() {
+		defer b.Unfollow(f)
+		for {
+			chunks := b.Next(f)
+			if len(chunks) == 0 {
+				copied <- nil
+				return
+			}
+			if err := writeChunks(chunks, w, w); err != nil {
+				copied <- err
+				return
+			}
+			b.advance(f, len(chunks))
+		}
+	}()
+
+	written := make(chan struct{})
+	go func() {
+		for _, s := range []string{"ab", "cd", "ef", "gh"} {
+			b.write(streamStdout, []byte(s))
+		}
+		b.Close()
+		close(written)
+	}()
+
+	select {
+	case <-written:
+		t.Fatal("writer did not block on a stalled follower")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(w.release)
+	<-written
+	if err := <-copied; err != nil {
+		t.Fatal(err)
+	}
+	if got := w.buf.String(); got != "abcdefgh" {
+		t.Errorf("follower got %q, want %q", got, "abcdefgh")
+	}
+}
+
+func TestOutputBufferUnfollowReleasesWriter(t *testing.T) {
+	b := newOutputBuffer(2)
+	f := b.Follow(0)
+	written := make(chan struct{})
+	go func() {
+		b.write(streamStdout, []byte("ab"))
+		b.write(streamStdout, []byte("cd"))
+		close(written)
+	}()
+	select {
+	case <-written:
+		t.Fatal("writer did not block on a stalled follower")
+	case <-time.After(50 * time.Millisecond):
+	}
+	b.Unfollow(f)
+	<-written
+	chunks, _ := b.Read(0)
+	if len(chunks) != 1 || string(chunks[0].data) != "cd" {
+		t.Errorf("scrollback after unfollow = %v", chunks)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/alessio/shellescape"
+	"github.com/brian14708/rexec/internal/asciicast"
+	"github.com/brian14708/rexec/internal/protocol"
+)
+
+// startRecording opens an asciicast recording for a job, nil if the server
+// does not record.
+func (d *daemon) startRecording(srv *server, req *protocol.ExecRequest, started time.Time) (*asciicast.Writer, error) {
+	dir := d.conf().Servers[srv.name].Record
+	if dir == "" {
+		return nil, nil
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(d.configDir, dir)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	name := fmt.Sprintf("%s-%s.cast", srv.name, started.Format("20060102-150405.000000"))
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	words := []string{shellescape.Quote(req.Command)}
+	for _, a := range req.Args {
+		words = append(words, shellescape.Quote(a))
+	}
+	h := asciicast.Header{
+		Width:     req.TerminalCols,
+		Height:    req.TerminalLines,
+		Timestamp: started.Unix(),
+		Command:   strings.Join(words, " "),
+	}
+	if req.TerminalName != "" {
+		h.Env = map[string]string{
+			"TERM": req.TerminalName,
+		}
+	}
+	w, err := asciicast.NewWriter(f, h)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
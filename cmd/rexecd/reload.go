@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// interval of checking config.toml for changes
+const configPollInterval = 2 * time.Second
+
+// current returns the config and servers in use, a reload replaces both.
+func (d *daemon) current() (Config, map[string]*server) {
+	d.configMu.RLock()
+	defer d.configMu.RUnlock()
+	return d.config, d.servers
+}
+
+func (d *daemon) conf() Config {
+	config, _ := d.current()
+	return config
+}
+
+// watchConfig reloads the config on SIGHUP or when config.toml changes.
+func (d *daemon) watchConfig() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	path := filepath.Join(d.configDir, "config.toml")
+	modTime := func() time.Time {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}
+		}
+		return fi.ModTime()
+	}
+	last := modTime()
+	t := time.NewTicker(configPollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-hup:
+			logrus.Infof("reloading config on SIGHUP")
+		case <-t.C:
+			m := modTime()
+			if m.Equal(last) {
+				continue
+			}
+			logrus.Infof("reloading changed config")
+		}
+		last = modTime()
+		d.reload()
+	}
+}
+
+// reload applies a new config. Jobs keep the settings they were started
+// with, removed servers and servers with new connection settings are closed
+// once their sessions ended, the other servers are updated in place. The old
+// config stays in use if the new one cannot be loaded. Changes to the
+// environment are not applied and reported as config error, the local
+// sandbox is only set up on start.
+func (d *daemon) reload() {
+	config, err := loadConfig(d.configDir)
+	if err != nil {
+		logrus.Errorf("keeping current config: %v", err)
+		d.configMu.Lock()
+		d.configErr = err
+		d.configMu.Unlock()
+		return
+	}
+
+	old, servers := d.current()
+	var configErr error
+	if !reflect.DeepEqual(old.Environment, config.Environment) {
+		configErr = errors.New("environment changes need a daemon restart")
+		logrus.Errorf("keeping current environment: %v", configErr)
+		config.Environment = old.Environment
+	}
+
+	keep := map[string]*server{}
+	added := Config{Servers: map[string]ServerConfig{}, LoadInterval: config.LoadInterval}
+	var retired []*server
+	for name, srv := range servers {
+		if cfg, ok := config.Servers[name]; ok && sameConnection(cfg, old.Servers[name]) {
+			srv.update(cfg)
+			keep[name] = srv
+		} else {
+			retired = append(retired, srv)
+		}
+	}
+	for name, cfg := range config.Servers {
+		if _, ok := keep[name]; !ok {
+			added.Servers[name] = cfg
+		}
+	}
+	if len(added.Servers) > 0 {
+		// reload runs on the watcher goroutine only
+		d.generation++
+		for name, srv := range connectServers(d.configDir, added, d.generation) {
+			keep[name] = srv
+		}
+	}
+
+	d.configMu.Lock()
+	d.config = config
+	d.servers = keep
+	d.loaded = time.Now()
+	d.configErr = configErr
+	d.configMu.Unlock()
+
+	for _, srv := range retired {
+		logrus.Infof("closing server %s once its sessions ended", srv.name)
+		srv.retire()
+	}
+}
+
+// sameConnection reports whether a server can keep its connection with the
+// new config, the other settings are applied by server.update or looked up
+// for every session.
+func sameConnection(a, b ServerConfig) bool {
+	return a.Host == b.Host && a.Port == b.Port && a.User == b.User
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/brian14708/rexec/internal/cmdutil"
+)
+
+func TestSameConnection(t *testing.T) {
+	base := ServerConfig{Host: "build1", Port: 22, User: "dev"}
+	tests := []struct {
+		name   string
+		change func(*ServerConfig)
+		same   bool
+	}{
+		{"unchanged", func(*ServerConfig) {}, true},
+		{"labels", func(c *ServerConfig) { c.Labels = map[string]string{"gpu": "1"} }, true},
+		{"keepalive", func(c *ServerConfig) { c.Keepalive = cmdutil.Duration(time.Minute) }, true},
+		{"lazy", func(c *ServerConfig) { c.Lazy = true }, true},
+		{"idle disconnect", func(c *ServerConfig) { c.IdleDisconnect = cmdutil.Duration(time.Hour) }, true},
+		{"host", func(c *ServerConfig) { c.Host = "build2" }, false},
+		{"port", func(c *ServerConfig) { c.Port = 2222 }, false},
+		{"user", func(c *ServerConfig) { c.User = "root" }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := base
+			tt.change(&cfg)
+			if got := sameConnection(base, cfg); got != tt.same {
+				t.Errorf("sameConnection = %v, want %v", got, tt.same)
+			}
+		})
+	}
+}
+
+func TestMountPointGeneration(t *testing.T) {
+	first := mountPoint("host-user-id", "build1", 0)
+	if first != "/tmp/rexec-host-user-id-build1" {
+		t.Errorf("mountPoint = %q", first)
+	}
+	if next := mountPoint("host-user-id", "build1", 1); next == first {
+		t.Errorf("reconnected server reuses mountpoint %q", next)
+	}
+}
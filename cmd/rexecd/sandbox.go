@@ -23,15 +23,7 @@ func execSandbox(configDir string, config Config) {
 		Args:    args,
 	}
 	for _, b := range config.Environment.Bind {
-		src := b.Source
-		if src == "" {
-			src = b.Path
-		}
-		spec.Bind = append(spec.Bind, sandbox.BindSpec{
-			Dst:  b.Path,
-			Src:  src,
-			Type: b.Mode,
-		})
+		spec.Bind = append(spec.Bind, b.spec())
 	}
 	spec.Bind = append(spec.Bind, sandbox.BindSpec{
 		Dst:  "/run",
@@ -75,13 +67,16 @@ func execSandbox(configDir string, config Config) {
 		json.NewDecoder(r).Decode(&m)
 
 		if m.ChildPID != 0 {
-			// wait for single term signal
+			// pass on SIGHUP to reload the config and a single term signal
 			sig := make(chan os.Signal, 1)
-			signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
-			s := <-sig
-			signal.Stop(sig)
-
-			syscall.Kill(m.ChildPID, s.(syscall.Signal))
+			signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+			for s := range sig {
+				syscall.Kill(m.ChildPID, s.(syscall.Signal))
+				if s != syscall.SIGHUP {
+					signal.Stop(sig)
+					return
+				}
+			}
 		}
 	}()
 
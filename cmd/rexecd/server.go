@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/brian14708/rexec/internal/protocol"
+	"github.com/brian14708/rexec/internal/sshconn"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	connConnected  = "connected"
+	connConnecting = "connecting"
+	// lazy server waiting for its first use
+	connIdle         = "idle"
+	connDisconnected = "disconnected"
+	connFailed       = "failed"
+
+	mountMounted   = "mounted"
+	mountUnmounted = "unmounted"
+	mountFailed    = "failed"
+)
+
+const (
+	defaultKeepalive = 15 * time.Second
+	connectTimeout   = 10 * time.Second
+
+	// delays between reconnect attempts
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+type server struct {
+	name string
+	host string
+	// where the local root is mounted on the server
+	mountpoint string
+	configDir  string
+	closed     chan struct{}
+	closeOnce  sync.Once
+	// wakes the supervisor of a lazy server
+	wake chan struct{}
+	// asks for a load sample right away, e.g. after connecting
+	sample chan struct{}
+	// tells the supervisor that the config changed, see update
+	reconfigure chan struct{}
+
+	mu  sync.Mutex
+	cfg ServerConfig
+	// broadcast on every state change
+	cond       *sync.Cond
+	conn       *sshconn.Conn
+	mount      *sshconn.MountTask
+	connState  string
+	mountState string
+	err        error
+	load       *protocol.ServerLoad
+	// next reconnect attempt, zero while connected and mounted
+	retry time.Time
+	// set while the supervisor of a lazy server waits for use
+	asleep bool
+	// completed connection attempts
+	attempts int
+	// holders of the connection, see use
+	users    int
+	lastUsed time.Time
+	// time it took to establish the current connection and mount
+	latency time.Duration
+}
+
+// connectServers starts supervising every configured server and returns
+// once the first connection attempt of each one finished. generation is
+// passed to mountPoint.
+func connectServers(configDir string, config Config, generation int) map[string]*server {
+	servers := map[string]*server{}
+	local := localName(configDir)
+	var wg sync.WaitGroup
+	for name, cfg := range config.Servers {
+		srv := &server{
+			name:        name,
+			host:        cfg.Host,
+			mountpoint:  mountPoint(local, name, generation),
+			configDir:   configDir,
+			closed:      make(chan struct{}),
+			wake:        make(chan struct{}, 1),
+			sample:      make(chan struct{}, 1),
+			reconfigure: make(chan struct{}, 1),
+			cfg:         cfg,
+			connState:   connDisconnected,
+			mountState:  mountUnmounted,
+		}
+		srv.cond = sync.NewCond(&srv.mu)
+		if cfg.Lazy {
+			srv.connState = connIdle
+			srv.asleep = true
+		}
+		servers[name] = srv
+		wg.Add(1)
+		go srv.supervise(wg.Done)
+		go srv.sampleLoad(config.LoadInterval.Or(defaultLoadInterval))
+	}
+	wg.Wait()
+	return servers
+}
+
+// supervise keeps the server connected and mounted until it is closed. Lost
+// connections are detected through keepalives, failed attempts are retried
+// with exponential backoff. Lazy servers connect on their first use and go
+// back to sleep when an attempt fails, servers with an idle period are
+// disconnected when nobody used them for that long. ready is called after
+// the first attempt, or right away for lazy servers.
+func (s *server) supervise(ready func()) {
+	backoff := minBackoff
+	asleep := s.config().Lazy
+	// set when asleep for being idle rather than lazy
+	idled := false
+	var conn *sshconn.Conn
+	var connLost <-chan struct{}
+	var mnt *sshconn.MountTask
+	var mountLost <-chan error
+	disconnect := func() {
+		if conn != nil {
+			conn.Close()
+		}
+		conn, connLost, mnt, mountLost = nil, nil, nil, nil
+		s.mu.Lock()
+		s.conn, s.mount = nil, nil
+		s.mu.Unlock()
+	}
+	for {
+		if asleep {
+			if ready != nil {
+				ready()
+				ready = nil
+			}
+			for asleep {
+				select {
+				case <-s.closed:
+					return
+				case <-s.wake:
+					asleep = false
+				case <-s.reconfigure:
+					// connect servers that are no longer lazy or idle
+					cfg := s.config()
+					asleep = cfg.Lazy || (idled && cfg.IdleDisconnect.Or(0) > 0)
+				}
+			}
+			idled = false
+			backoff = minBackoff
+		}
+		select {
+		case <-s.closed:
+			return
+		default:
+		}
+
+		fresh := conn == nil || mnt == nil
+		begin := time.Now()
+		if conn == nil {
+			if conn = s.dial(); conn != nil {
+				connLost = waitConn(conn)
+			}
+		}
+		if conn != nil && mnt == nil {
+			if mnt = s.mountRoot(conn); mnt != nil {
+				mountLost = waitMount(mnt)
+			}
+		}
+		s.mu.Lock()
+		s.asleep = false
+		s.attempts++
+		s.cond.Broadcast()
+		s.mu.Unlock()
+		if ready != nil {
+			ready()
+			ready = nil
+		}
+		if fresh && conn != nil && mnt != nil {
+			// the idle period starts with the connection
+			s.mu.Lock()
+			s.lastUsed = time.Now()
+			s.latency = s.lastUsed.Sub(begin)
+			s.mu.Unlock()
+			select {
+			case s.sample <- struct{}{}:
+			default:
+			}
+		}
+
+		var retry <-chan time.Time
+		if conn == nil || mnt == nil {
+			if s.config().Lazy {
+				connected := conn != nil
+				disconnect()
+				// asleep together with the state, so Conn wakes the
+				// server instead of failing
+				s.mu.Lock()
+				if connected {
+					s.connState = connDisconnected
+				}
+				s.asleep = true
+				s.retry = time.Time{}
+				s.cond.Broadcast()
+				s.mu.Unlock()
+				asleep = true
+				continue
+			}
+			logrus.Infof("retrying %s in %s", s.name, backoff)
+			s.mu.Lock()
+			s.retry = time.Now().Add(backoff)
+			s.mu.Unlock()
+			retry = time.After(backoff)
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		} else {
+			backoff = minBackoff
+		}
+
+	wait:
+		for {
+			// the idle period is looked up again after every config change
+			var idle <-chan time.Time
+			idlePeriod := s.config().IdleDisconnect.Or(0)
+			if conn != nil && mnt != nil && idlePeriod > 0 {
+				idle = time.After(s.idleFor(idlePeriod))
+			}
+			select {
+			case <-s.closed:
+				if conn != nil {
+					conn.Close()
+				}
+				return
+			case <-connLost:
+				logrus.Warnf("connection to %s lost", s.name)
+				disconnect()
+				s.setState(connDisconnected, mountUnmounted, errors.New("connection lost"))
+			case err := <-mountLost:
+				if err == nil {
+					err = errors.New("sshfs exited")
+				}
+				logrus.Warnf("mount on %s lost: %v", s.name, err)
+				s.mu.Lock()
+				s.mount = nil
+				s.mu.Unlock()
+				s.setState(connConnected, mountFailed, errors.Wrap(err, "mount lost"))
+				mnt, mountLost = nil, nil
+			case <-retry:
+				s.mu.Lock()
+				s.retry = time.Time{}
+				s.mu.Unlock()
+			case <-idle:
+				if s.idleFor(idlePeriod) > 0 {
+					continue
+				}
+				logrus.Infof("disconnecting idle server %s", s.name)
+				disconnect()
+				s.mu.Lock()
+				s.connState, s.mountState, s.err = connIdle, mountUnmounted, nil
+				s.asleep = true
+				s.cond.Broadcast()
+				s.mu.Unlock()
+				asleep, idled = true, true
+			case <-s.reconfigure:
+				continue
+			}
+			break wait
+		}
+	}
+}
+
+// config returns the current settings of the server.
+func (s *server) config() ServerConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cfg
+}
+
+// update applies new settings that do not need a new connection. Labels are
+// used right away, the lazy and idle settings by the supervisor and the
+// keepalive interval from the next connection on.
+func (s *server) update(cfg ServerConfig) {
+	s.mu.Lock()
+	s.cfg = cfg
+	s.mu.Unlock()
+	select {
+	case s.reconfigure <- struct{}{}:
+	default:
+	}
+}
+
+// idleFor returns how long the server has to stay unused to be idle for
+// period, zero if it already is.
+func (s *server) idleFor(period time.Duration) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.users > 0 {
+		return period
+	}
+	if d := period - time.Since(s.lastUsed); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// use marks the connection as used until the returned function is called,
+// the server is not disconnected for being idle meanwhile.
+func (s *server) use() func() {
+	s.mu.Lock()
+	s.users++
+	s.lastUsed = time.Now()
+	s.mu.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			s.users--
+			s.lastUsed = time.Now()
+			s.cond.Broadcast()
+			s.mu.Unlock()
+		})
+	}
+}
+
+func (s *server) dial() *sshconn.Conn {
+	s.mu.Lock()
+	s.connState = connConnecting
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	cfg := s.config()
+	port := ""
+	if cfg.Port != 0 {
+		port = fmt.Sprintf("%d", cfg.Port)
+	}
+	conn, err := sshconn.New(sshconn.Config{
+		Host: cfg.Host,
+		Port: port,
+		User: cfg.User,
+
+		KnownHostsFile: filepath.Join(s.configDir, "known_hosts"),
+		DialTimeout:    connectTimeout,
+	})
+	if err != nil {
+		logrus.Warnf("failed to connect to %s: %v", s.name, err)
+		s.setState(connFailed, mountUnmounted, errors.Wrap(err, "connect failed"))
+		return nil
+	}
+	keepalive := cfg.Keepalive.Or(defaultKeepalive)
+	conn.Keepalive(keepalive, keepalive)
+
+	s.mu.Lock()
+	s.conn = conn
+	s.mu.Unlock()
+	s.setState(connConnected, mountUnmounted, nil)
+	return conn
+}
+
+func (s *server) mountRoot(conn *sshconn.Conn) *sshconn.MountTask {
+	mnt, err := conn.RemoteMount(context.TODO(), "/", s.mountpoint, "-o kernel_cache -o auto_cache -o negative_timeout=5 -o entry_timeout=5 -o attr_timeout=5 -o max_readahead=90000")
+	if err != nil {
+		logrus.Warnf("failed to mount on %s: %v", s.name, err)
+		s.setState(connConnected, mountFailed, errors.Wrap(err, "mount failed"))
+		return nil
+	}
+	s.mu.Lock()
+	s.mount = mnt
+	s.retry = time.Time{}
+	s.mu.Unlock()
+	s.setState(connConnected, mountMounted, nil)
+	return mnt
+}
+
+func waitConn(conn *sshconn.Conn) <-chan struct{} {
+	ch := make(chan struct{})
+	go func() {
+		conn.Wait()
+		close(ch)
+	}()
+	return ch
+}
+
+func waitMount(mnt *sshconn.MountTask) <-chan error {
+	ch := make(chan error, 1)
+	go func() {
+		ch <- mnt.Wait()
+	}()
+	return ch
+}
+
+func (s *server) setState(conn, mount string, err error) {
+	s.mu.Lock()
+	s.connState = conn
+	s.mountState = mount
+	s.err = err
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// Conn returns the connection of the server if it is ready to run commands,
+// a sleeping lazy server is connected first.
+func (s *server) Conn() (*sshconn.Conn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastUsed = time.Now()
+	if s.asleep {
+		attempts := s.attempts
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+		for s.attempts == attempts {
+			s.cond.Wait()
+		}
+	}
+	return s.connLocked()
+}
+
+// connected is Conn without connecting sleeping servers or counting as use.
+func (s *server) connected() (*sshconn.Conn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connLocked()
+}
+
+func (s *server) connLocked() (*sshconn.Conn, error) {
+	category := protocol.ErrorConnect
+	if s.connState == connConnected {
+		category = protocol.ErrorMount
+	}
+	if s.err != nil {
+		return nil, &execError{category, s.err}
+	}
+	if s.conn == nil || s.mount == nil {
+		return nil, &execError{category, errors.New("not connected")}
+	}
+	return s.conn, nil
+}
+
+// Latency returns how long it took to establish the current connection.
+func (s *server) Latency() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.latency
+}
+
+func (s *server) Status() protocol.ServerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := protocol.ServerStatus{
+		Name:       s.name,
+		Host:       s.host,
+		Labels:     s.cfg.Labels,
+		Connection: s.connState,
+		Mount:      s.mountState,
+		Load:       s.load,
+		Retry:      s.retry,
+	}
+	if s.err != nil {
+		st.Error = s.err.Error()
+	}
+	return st
+}
+
+// retire closes the server once nobody uses it anymore.
+func (s *server) retire() {
+	go func() {
+		s.mu.Lock()
+		for s.users > 0 {
+			s.cond.Wait()
+		}
+		s.mu.Unlock()
+		s.Close()
+	}()
+}
+
+func (s *server) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+	s.mu.Lock()
+	conn := s.conn
+	// release callers waiting for a connection attempt
+	s.asleep = false
+	s.attempts++
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	return conn.Close()
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"path"
+
+	"github.com/brian14708/rexec/internal/envpolicy"
+	"github.com/brian14708/rexec/internal/pathmap"
+	"github.com/brian14708/rexec/internal/protocol"
+	"github.com/brian14708/rexec/internal/sandbox"
+	"github.com/pkg/errors"
+)
+
+// sandboxEnv applies the forwarding policy to the client environment. The
+// rules of the server take precedence over the global ones, which take
+// precedence over envpolicy.DefaultDeny. The variables set in config and the
+// ones given explicitly by the client are not filtered.
+func (d *daemon) sandboxEnv(srv *server, p ProfileConfig, req *protocol.ExecRequest) []string {
+	config := d.conf()
+	global := config.Env
+	local := config.Servers[srv.name].Env
+
+	rules := []envpolicy.Rules{
+		{Allow: local.Allow, Deny: local.Deny},
+		{Allow: global.Allow, Deny: global.Deny},
+	}
+	if !global.NoDefaultDeny && !local.NoDefaultDeny {
+		rules = append(rules, envpolicy.Rules{Deny: envpolicy.DefaultDeny})
+	}
+	env := envpolicy.Filter(req.Env, rules...)
+	return envpolicy.Merge(env,
+		envpolicy.FromMap(global.Set),
+		envpolicy.FromMap(local.Set),
+		envpolicy.FromMap(p.Env),
+		req.ExtraEnv,
+		[]string{"REXEC=1", "REXEC_SERVER=" + srv.name},
+	)
+}
+
+// pathMapper returns the path mapping of a profile, falling back to the
+// rules of the server and the global rules.
+func (d *daemon) pathMapper(srv *server, p ProfileConfig) (pathmap.Mapper, error) {
+	config := d.conf()
+	rules := config.PathMap
+	if local := config.Servers[srv.name].PathMap; len(local) != 0 {
+		rules = local
+	}
+	if len(p.PathMap) != 0 {
+		rules = p.PathMap
+	}
+	return pathmap.New(rules)
+}
+
+func (d *daemon) sandboxSpec(srv *server, p ProfileConfig, m pathmap.Mapper, req *protocol.ExecRequest) (*sandbox.Spec, error) {
+	cwd, err := m.ToRemote(req.WorkingDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot map working directory")
+	}
+
+	env := d.sandboxEnv(srv, p, req)
+	for i, e := range env {
+		if envpolicy.Key(e) == "PWD" {
+			env[i] = "PWD=" + cwd
+		}
+	}
+
+	config := d.conf()
+	scope, err := scopeName()
+	if err != nil {
+		return nil, err
+	}
+
+	mountRoot := srv.mountpoint
+	var binds []sandbox.BindSpec
+	if m.IsIdentity() {
+		binds = append(binds, sandbox.BindSpec{
+			Dst:  "/",
+			Src:  mountRoot,
+			Type: sandbox.BindReadWrite,
+		})
+	} else {
+		// the remote root with the mapped local directories on top, it is
+		// read-only so jobs write only to mapped directories, the tmpfs
+		// mounts and configured binds
+		binds = append(binds, sandbox.BindSpec{
+			Dst:  "/",
+			Src:  "/",
+			Type: sandbox.BindReadOnly,
+		})
+		for _, r := range m.Rules() {
+			binds = append(binds, sandbox.BindSpec{
+				Dst:  r.Remote,
+				Src:  path.Join(mountRoot, r.Local),
+				Type: sandbox.BindReadWrite,
+			})
+		}
+	}
+
+	s := &sandbox.Spec{
+		Command:    m.Args([]string{req.Command})[0],
+		Args:       m.Args(req.Args),
+		WorkingDir: cwd,
+		Env:        env,
+		Bind: append(binds,
+			sandbox.BindSpec{
+				Dst:  "/etc/resolv.conf",
+				Src:  "/etc/resolv.conf",
+				Type: sandbox.BindReadOnly,
+			},
+			sandbox.BindSpec{
+				Dst:  "/sys",
+				Src:  "/sys",
+				Type: sandbox.BindReadOnly,
+			},
+			sandbox.BindSpec{
+				Dst:  "/run",
+				Type: sandbox.BindTmpFS,
+			},
+			sandbox.BindSpec{
+				Dst:  "/tmp",
+				Type: sandbox.BindTmpFS,
+			},
+			sandbox.BindSpec{
+				Dst:  "/dev",
+				Type: sandbox.BindDevFS,
+			},
+			sandbox.BindSpec{
+				Dst:  "/proc",
+				Type: sandbox.BindProcFS,
+			},
+		),
+		UnshareNamespace: true,
+
+		Limits:     config.Limits.Override(config.Servers[srv.name].Limits).Tighten(req.Limits),
+		LimitScope: scope,
+		InfoFile:   "/tmp/" + scope + ".info",
+	}
+	// configured binds win over the defaults at the same path
+	for _, b := range config.Servers[srv.name].Bind {
+		s.Bind = append(s.Bind, b.spec())
+	}
+	for _, b := range p.Bind {
+		s.Bind = append(s.Bind, b.spec())
+	}
+	return s, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/brian14708/rexec/internal/protocol"
+	"github.com/brian14708/rexec/internal/sshconn"
+	"github.com/brian14708/rexec/internal/syncdir"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const defaultSyncCache = ".cache/rexec/sync"
+
+// syncedDir is a working directory copied to the server for a job. The copy
+// is shared by all jobs with the same working directory, lock only
+// serializes the transfers, not the jobs using it.
+type syncedDir struct {
+	conn    *sshconn.Conn
+	tree    syncdir.Tree
+	outputs []string
+	lock    *sync.Mutex
+}
+
+// syncWorkdir copies the working directory of req into the sync cache of
+// the server when sync mode is on, it returns nil otherwise.
+func (d *daemon) syncWorkdir(conn *sshconn.Conn, srv *server, req *protocol.ExecRequest) (*syncedDir, error) {
+	cfg := d.conf().Servers[srv.name].Sync
+	enabled := cfg.Enabled
+	if req.Sync != nil {
+		enabled = *req.Sync
+	}
+	if !enabled {
+		return nil, nil
+	}
+
+	client, err := conn.SFTP()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to start sftp session")
+	}
+	defer client.Close()
+
+	cache := cfg.CacheDir
+	if cache == "" {
+		cache = defaultSyncCache
+	}
+	if !path.IsAbs(cache) {
+		home, err := client.Getwd()
+		if err != nil {
+			return nil, err
+		}
+		cache = path.Join(home, cache)
+	}
+	hostname, _ := os.Hostname()
+	key := sha256.Sum256([]byte(hostname + ":" + req.WorkingDir))
+
+	s := &syncedDir{
+		conn: conn,
+		tree: syncdir.Tree{
+			Local:   req.WorkingDir,
+			Remote:  path.Join(cache, hex.EncodeToString(key[:8])),
+			Exclude: cfg.Exclude,
+		},
+		outputs: append(append([]string(nil), cfg.Outputs...), req.SyncOutputs...),
+		lock:    d.syncLock(req.WorkingDir),
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.tree.Client = client
+	m, err := s.tree.LoadManifest()
+	if err != nil {
+		return nil, err
+	}
+	m, stats, err := s.tree.Push(m)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot sync working directory")
+	}
+	if err := s.tree.SaveManifest(m); err != nil {
+		return nil, err
+	}
+	logrus.Infof("synced %s to %s:%s, %d files (%d bytes) uploaded, %d removed",
+		s.tree.Local, srv.name, s.tree.Remote, stats.Uploaded, stats.Bytes, stats.Removed)
+	return s, nil
+}
+
+// pullOutputs copies the declared outputs back to the local directory.
+func (s *syncedDir) pullOutputs() error {
+	if len(s.outputs) == 0 {
+		return nil
+	}
+	client, err := s.conn.SFTP()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.tree.Client = client
+	m, err := s.tree.LoadManifest()
+	if err != nil {
+		return err
+	}
+	stats, err := s.tree.Pull(m, s.outputs)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("synced outputs of %s back, %d files (%d bytes)", s.tree.Local, stats.Downloaded, stats.Bytes)
+	return s.tree.SaveManifest(m)
+}
+
+// syncLock serializes syncs of the same local directory.
+func (d *daemon) syncLock(dir string) *sync.Mutex {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.syncLocks == nil {
+		d.syncLocks = make(map[string]*sync.Mutex)
+	}
+	l, ok := d.syncLocks[dir]
+	if !ok {
+		l = &sync.Mutex{}
+		d.syncLocks[dir] = l
+	}
+	return l
+}
@@ -0,0 +1,192 @@
+// Package asciicast reads and writes terminal recordings in the asciicast
+// v2 format used by asciinema.
+package asciicast
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// Event types, EventError is not part of asciicast v2 and tags stderr of
+// recordings made without a PTY.
+const (
+	EventOutput = "o"
+	EventError  = "e"
+	EventResize = "r"
+)
+
+type Header struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Command   string            `json:"command,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+type Event struct {
+	Time float64
+	Type string
+	Data string
+}
+
+// Writer records events relative to the time it was created. It is safe
+// for concurrent use.
+type Writer struct {
+	mu      sync.Mutex
+	w       io.WriteCloser
+	start   time.Time
+	pending map[string][]byte
+	closed  bool
+	err     error
+}
+
+func NewWriter(w io.WriteCloser, h Header) (*Writer, error) {
+	h.Version = 2
+	if h.Width == 0 || h.Height == 0 {
+		h.Width, h.Height = 80, 24
+	}
+	start := time.Now()
+	if h.Timestamp == 0 {
+		h.Timestamp = start.Unix()
+	}
+	b, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append(b, '\n')); err != nil {
+		return nil, err
+	}
+	return &Writer{
+		w:       w,
+		start:   start,
+		pending: make(map[string][]byte),
+	}, nil
+}
+
+// Stream returns a writer recording everything written as events of type
+// typ, incomplete UTF-8 sequences are held back until the next write.
+func (w *Writer) Stream(typ string) io.Writer {
+	return streamWriter{w, typ}
+}
+
+type streamWriter struct {
+	w   *Writer
+	typ string
+}
+
+func (s streamWriter) Write(p []byte) (int, error) {
+	s.w.mu.Lock()
+	defer s.w.mu.Unlock()
+	data := append(s.w.pending[s.typ], p...)
+	n := len(data)
+	// cut an incomplete trailing rune
+	for i := 1; i < utf8.UTFMax && i <= len(data); i++ {
+		if utf8.RuneStart(data[len(data)-i]) {
+			if !utf8.FullRune(data[len(data)-i:]) {
+				n = len(data) - i
+			}
+			break
+		}
+	}
+	s.w.pending[s.typ] = append([]byte(nil), data[n:]...)
+	if n > 0 {
+		s.w.event(s.typ, string(data[:n]))
+	}
+	return len(p), nil
+}
+
+func (w *Writer) Resize(cols, lines int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.event(EventResize, fmt.Sprintf("%dx%d", cols, lines))
+}
+
+func (w *Writer) event(typ, data string) {
+	if w.closed || w.err != nil {
+		return
+	}
+	t := time.Since(w.start).Seconds()
+	b, err := json.Marshal([]interface{}{t, typ, data})
+	if err == nil {
+		_, err = w.w.Write(append(b, '\n'))
+	}
+	w.err = err
+}
+
+// Close flushes held back data and closes the underlying writer, it
+// returns the first error encountered while recording.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for typ, data := range w.pending {
+		if len(data) > 0 {
+			w.event(typ, string(data))
+		}
+	}
+	w.pending = make(map[string][]byte)
+	w.closed = true
+	if err := w.w.Close(); w.err == nil {
+		w.err = err
+	}
+	return w.err
+}
+
+// Reader reads a recording.
+type Reader struct {
+	Header Header
+	s      *bufio.Scanner
+}
+
+func NewReader(r io.Reader) (*Reader, error) {
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 16<<20)
+	if !s.Scan() {
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("empty recording")
+	}
+	var h Header
+	if err := json.Unmarshal(s.Bytes(), &h); err != nil {
+		return nil, errors.Wrap(err, "invalid header")
+	}
+	if h.Version != 2 {
+		return nil, errors.Errorf("unsupported asciicast version %d", h.Version)
+	}
+	return &Reader{Header: h, s: s}, nil
+}
+
+// Next returns the next event, io.EOF at the end of the recording.
+func (r *Reader) Next() (*Event, error) {
+	for r.s.Scan() {
+		if len(r.s.Bytes()) == 0 {
+			continue
+		}
+		var raw []interface{}
+		if err := json.Unmarshal(r.s.Bytes(), &raw); err != nil {
+			return nil, errors.Wrap(err, "invalid event")
+		}
+		if len(raw) != 3 {
+			return nil, errors.New("invalid event")
+		}
+		t, ok1 := raw[0].(float64)
+		typ, ok2 := raw[1].(string)
+		data, ok3 := raw[2].(string)
+		if !ok1 || !ok2 || !ok3 {
+			return nil, errors.New("invalid event")
+		}
+		return &Event{t, typ, data}, nil
+	}
+	if err := r.s.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
@@ -0,0 +1,185 @@
+package asciicast
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type nopCloser struct {
+	bytes.Buffer
+}
+
+func (nopCloser) Close() error { return nil }
+
+func record(t *testing.T, writes [][]byte) []Event {
+	t.Helper()
+	var buf nopCloser
+	w, err := NewWriter(&buf, Header{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := w.Stream(EventOutput)
+	for _, p := range writes {
+		if n, err := out.Write(p); err != nil || n != len(p) {
+			t.Fatalf("Write(%q) = %d, %v", p, n, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []Event
+	for {
+		e, err := r.Next()
+		if err == io.EOF {
+			return events
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Time < 0 {
+			t.Errorf("negative event time %v", e.Time)
+		}
+		events = append(events, Event{Type: e.Type, Data: e.Data})
+	}
+}
+
+func TestStreamWriter(t *testing.T) {
+	euro := []byte("€")  // 3 bytes
+	emoji := []byte("😀") // 4 bytes
+	tests := []struct {
+		name   string
+		writes [][]byte
+		want   []string
+	}{
+		{"ascii", [][]byte{[]byte("hi")}, []string{"hi"}},
+		{"complete rune", [][]byte{euro}, []string{"€"}},
+		{"rune split 1+2", [][]byte{euro[:1], euro[1:]}, []string{"€"}},
+		{"rune split 2+1", [][]byte{[]byte("a"), append([]byte("b"), euro[:2]...), euro[2:]}, []string{"a", "b", "€"}},
+		{"rune split byte by byte", [][]byte{emoji[:1], emoji[1:2], emoji[2:3], emoji[3:]}, []string{"😀"}},
+		{"text before split rune", [][]byte{append([]byte("x"), emoji[:3]...), emoji[3:]}, []string{"x", "😀"}},
+		{"incomplete at close", [][]byte{[]byte("a"), euro[:2]}, []string{"a", "��"}},
+		{"invalid byte", [][]byte{{0xff}}, []string{"�"}},
+		{"stray continuation", [][]byte{euro[1:]}, []string{"��"}},
+		{"empty write", [][]byte{{}}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, e := range record(t, tt.writes) {
+				if e.Type != EventOutput {
+					t.Errorf("event type %q", e.Type)
+				}
+				got = append(got, e.Data)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("events = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriterStreams(t *testing.T) {
+	var buf nopCloser
+	w, err := NewWriter(&buf, Header{Width: 100, Height: 40, Command: "sh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Stream(EventOutput).Write([]byte("out"))
+	w.Stream(EventError).Write([]byte("err"))
+	w.Resize(120, 50)
+	w.Close()
+	// writes after close are dropped
+	w.Stream(EventOutput).Write([]byte("late"))
+
+	r, err := NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Header{Version: 2, Width: 100, Height: 40, Timestamp: r.Header.Timestamp, Command: "sh"}
+	if !reflect.DeepEqual(r.Header, want) || r.Header.Timestamp == 0 {
+		t.Errorf("header = %+v", r.Header)
+	}
+	var got []Event
+	for {
+		e, err := r.Next()
+		if err != nil {
+			break
+		}
+		got = append(got, Event{Type: e.Type, Data: e.Data})
+	}
+	wantEvents := []Event{{0, "o", "out"}, {0, "e", "err"}, {0, "r", "120x50"}}
+	if !reflect.DeepEqual(got, wantEvents) {
+		t.Errorf("events = %+v, want %+v", got, wantEvents)
+	}
+}
+
+func TestNewWriterDefaultSize(t *testing.T) {
+	var buf nopCloser
+	if _, err := NewWriter(&buf, Header{Width: 100}); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Header.Width != 80 || r.Header.Height != 24 {
+		t.Errorf("size = %dx%d, want 80x24", r.Header.Width, r.Header.Height)
+	}
+}
+
+func TestReader(t *testing.T) {
+	header := `{"version": 2, "width": 80, "height": 24}` + "\n"
+	tests := []struct {
+		name      string
+		in        string
+		headerErr bool
+		events    int
+		eventErr  bool
+	}{
+		{"empty", "", true, 0, false},
+		{"invalid header", "{\n", true, 0, false},
+		{"version 1", `{"version": 1}` + "\n", true, 0, false},
+		{"header only", header, false, 0, false},
+		{"events", header + `[0.1, "o", "a"]` + "\n" + `[0.2, "r", "80x24"]` + "\n", false, 2, false},
+		{"blank lines", header + "\n" + `[0.1, "o", "a"]` + "\n\n", false, 1, false},
+		{"no trailing newline", header + `[0.1, "o", "a"]`, false, 1, false},
+		{"invalid json", header + "[0.1,\n", false, 0, true},
+		{"too few fields", header + `[0.1, "o"]` + "\n", false, 0, true},
+		{"wrong time type", header + `["0.1", "o", "a"]` + "\n", false, 0, true},
+		{"wrong data type", header + `[0.1, "o", 1]` + "\n", false, 0, true},
+		{"error after events", header + `[0.1, "o", "a"]` + "\n{}\n", false, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewReader(strings.NewReader(tt.in))
+			if (err != nil) != tt.headerErr {
+				t.Fatalf("NewReader error = %v, want error %v", err, tt.headerErr)
+			}
+			if err != nil {
+				return
+			}
+			n := 0
+			for {
+				_, err = r.Next()
+				if err != nil {
+					break
+				}
+				n++
+			}
+			if n != tt.events {
+				t.Errorf("read %d events, want %d", n, tt.events)
+			}
+			if (err != io.EOF) != tt.eventErr {
+				t.Errorf("Next error = %v, want error %v", err, tt.eventErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package envpolicy
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// DefaultDeny lists variables that only make sense on the local machine. It
+// is applied below all configured rules, allowing a variable explicitly
+// forwards it anyway.
+var DefaultDeny = []string{
+	"DISPLAY",
+	"WAYLAND_DISPLAY",
+	"XAUTHORITY",
+	"XDG_*",
+	"DBUS_SESSION_BUS_ADDRESS",
+	"SSH_AUTH_SOCK",
+	"SSH_AGENT_PID",
+	"SSH_CLIENT",
+	"SSH_CONNECTION",
+	"SSH_TTY",
+	"GPG_AGENT_INFO",
+	"TMUX",
+	"TMUX_PANE",
+}
+
+// Rules select variables by name with glob patterns. A variable matching
+// Deny is dropped, one matching Allow is forwarded. If it matches neither it
+// is left to less specific rules, and dropped if any rules have an Allow
+// list.
+type Rules struct {
+	Allow []string
+	Deny  []string
+}
+
+// decide returns whether the rules forward key, ok is false if no pattern
+// matches it.
+func (r Rules) decide(key string) (pass, ok bool) {
+	if matchAny(r.Deny, key) {
+		return false, true
+	}
+	if matchAny(r.Allow, key) {
+		return true, true
+	}
+	return false, false
+}
+
+func matchAny(patterns []string, key string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Match reports whether key is forwarded by rules, given from the most to
+// the least specific. The first rules with a matching pattern decide.
+func Match(key string, rules ...Rules) bool {
+	restricted := false
+	for _, r := range rules {
+		if pass, ok := r.decide(key); ok {
+			return pass
+		}
+		if len(r.Allow) != 0 {
+			restricted = true
+		}
+	}
+	return !restricted
+}
+
+// Filter returns the entries of env that are forwarded by rules, given from
+// the most to the least specific.
+func Filter(env []string, rules ...Rules) []string {
+	var ret []string
+	for _, e := range env {
+		if Match(Key(e), rules...) {
+			ret = append(ret, e)
+		}
+	}
+	return ret
+}
+
+// Merge applies the overrides to env in order, a later definition of a
+// variable replaces an earlier one.
+func Merge(env []string, overrides ...[]string) []string {
+	var ret []string
+	index := map[string]int{}
+	add := func(e string) {
+		key := Key(e)
+		if i, ok := index[key]; ok {
+			ret[i] = e
+			return
+		}
+		index[key] = len(ret)
+		ret = append(ret, e)
+	}
+
+	for _, e := range env {
+		add(e)
+	}
+	for _, o := range overrides {
+		for _, e := range o {
+			add(e)
+		}
+	}
+	return ret
+}
+
+// FromMap converts a map of variables to KEY=VALUE entries sorted by key.
+func FromMap(m map[string]string) []string {
+	ret := make([]string, 0, len(m))
+	for k, v := range m {
+		ret = append(ret, k+"="+v)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func Key(e string) string {
+	if i := strings.IndexByte(e, '='); i >= 0 {
+		return e[:i]
+	}
+	return e
+}
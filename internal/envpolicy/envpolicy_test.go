@@ -0,0 +1,93 @@
+package envpolicy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	defaults := Rules{Deny: DefaultDeny}
+	tests := []struct {
+		name  string
+		key   string
+		rules []Rules
+		want  bool
+	}{
+		{"no rules", "FOO", nil, true},
+		{"default deny", "DISPLAY", []Rules{{}, defaults}, false},
+		{"default deny glob", "XDG_RUNTIME_DIR", []Rules{defaults}, false},
+		{"not in default deny", "PATH", []Rules{defaults}, true},
+		{"allow overrides default deny", "SSH_AUTH_SOCK", []Rules{{Allow: []string{"SSH_AUTH_SOCK"}}, defaults}, true},
+		{"allow list drops others", "HOME", []Rules{{Allow: []string{"GO*"}}}, false},
+		{"allow list glob", "GOPATH", []Rules{{Allow: []string{"GO*"}}}, true},
+		{"deny beats allow in same rules", "GOPATH", []Rules{{Allow: []string{"GO*"}, Deny: []string{"GOPATH"}}}, false},
+		{"server allow overrides global deny", "TOKEN", []Rules{{Allow: []string{"TOKEN"}}, {Deny: []string{"TOKEN"}}}, true},
+		{"server deny overrides global allow", "TOKEN", []Rules{{Deny: []string{"TOKEN"}}, {Allow: []string{"TOKEN"}}}, false},
+		{"global allow list applies below server", "HOME", []Rules{{Deny: []string{"X"}}, {Allow: []string{"GO*"}}}, false},
+		{"server allow list extends global", "CC", []Rules{{Allow: []string{"CC"}}, {Allow: []string{"GO*"}}}, true},
+		{"invalid pattern never matches", "FOO", []Rules{{Deny: []string{"["}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Match(tt.key, tt.rules...); got != tt.want {
+				t.Errorf("Match(%q) = %v, want %v", tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilter(t *testing.T) {
+	env := []string{"PATH=/bin", "DISPLAY=:0", "EMPTY=", "NOVALUE", "XDG_SESSION_ID=1"}
+	got := Filter(env, Rules{Deny: DefaultDeny})
+	want := []string{"PATH=/bin", "EMPTY=", "NOVALUE"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Filter = %q, want %q", got, want)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       []string
+		overrides [][]string
+		want      []string
+	}{
+		{"empty", nil, nil, nil},
+		{"no overrides", []string{"A=1"}, nil, []string{"A=1"}},
+		{"replace keeps order", []string{"A=1", "B=2"}, [][]string{{"A=3"}}, []string{"A=3", "B=2"}},
+		{"later wins", []string{"A=1"}, [][]string{{"A=2"}, {"A=3"}}, []string{"A=3"}},
+		{"append new", []string{"A=1"}, [][]string{{"B=2"}}, []string{"A=1", "B=2"}},
+		{"value with equals", []string{"A=x=y"}, [][]string{{"A=z"}}, []string{"A=z"}},
+		{"duplicate in env", []string{"A=1", "A=2"}, nil, []string{"A=2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Merge(tt.env, tt.overrides...); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Merge = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKey(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"A=1", "A"},
+		{"A=", "A"},
+		{"A", "A"},
+		{"A=b=c", "A"},
+		{"=x", ""},
+	}
+	for _, tt := range tests {
+		if got := Key(tt.in); got != tt.want {
+			t.Errorf("Key(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFromMap(t *testing.T) {
+	got := FromMap(map[string]string{"B": "2", "A": "1"})
+	want := []string{"A=1", "B=2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FromMap = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,101 @@
+// Package forward parses port forwarding specifications and relays data
+// between forwarded connections.
+package forward
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Spec is a single forwarding, connections accepted on Listen are relayed to
+// Connect.
+type Spec struct {
+	Listen  string
+	Connect string
+}
+
+// Parse parses "[bind_address:]port:host:hostport" like ssh -L and -R, the
+// bind address defaults to localhost. IPv6 addresses are written in
+// brackets.
+func Parse(s string) (Spec, error) {
+	parts, err := split(s)
+	if err != nil {
+		return Spec{}, err
+	}
+	switch len(parts) {
+	case 3:
+		parts = append([]string{"localhost"}, parts...)
+	case 4:
+	default:
+		return Spec{}, errors.Errorf("invalid forwarding %q, expected [bind_address:]port:host:hostport", s)
+	}
+	for _, p := range []string{parts[1], parts[2], parts[3]} {
+		if p == "" {
+			return Spec{}, errors.Errorf("invalid forwarding %q", s)
+		}
+	}
+	return Spec{
+		Listen:  net.JoinHostPort(parts[0], parts[1]),
+		Connect: net.JoinHostPort(parts[2], parts[3]),
+	}, nil
+}
+
+func split(s string) ([]string, error) {
+	var parts []string
+	for s != "" {
+		var p string
+		if s[0] == '[' {
+			end := strings.IndexByte(s, ']')
+			if end < 0 {
+				return nil, errors.Errorf("missing ']' in %q", s)
+			}
+			p, s = s[1:end], s[end+1:]
+			if s != "" && s[0] != ':' {
+				return nil, errors.Errorf("unexpected %q after address", s)
+			}
+		} else if i := strings.IndexByte(s, ':'); i >= 0 {
+			p, s = s[:i], s[i:]
+		} else {
+			p, s = s, ""
+		}
+		parts = append(parts, p)
+		if s != "" {
+			s = s[1:]
+			if s == "" {
+				parts = append(parts, "")
+			}
+		}
+	}
+	return parts, nil
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Pipe copies data in both directions between a and b and closes both once
+// neither has anything left to send. Half-closes are passed on where the
+// receiving side supports them.
+func Pipe(a, b io.ReadWriteCloser) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go copyHalf(a, b, &wg)
+	go copyHalf(b, a, &wg)
+	wg.Wait()
+	a.Close()
+	b.Close()
+}
+
+func copyHalf(dst, src io.ReadWriteCloser, wg *sync.WaitGroup) {
+	defer wg.Done()
+	io.Copy(dst, src)
+	if cw, ok := dst.(closeWriter); ok && cw.CloseWrite() == nil {
+		return
+	}
+	dst.Close()
+	src.Close()
+}
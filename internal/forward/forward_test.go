@@ -0,0 +1,67 @@
+package forward
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in      string
+		listen  string
+		connect string
+		err     bool
+	}{
+		{"8080:localhost:80", "localhost:8080", "localhost:80", false},
+		{"0.0.0.0:8080:db:5432", "0.0.0.0:8080", "db:5432", false},
+		{":8080:db:5432", ":8080", "db:5432", false},
+		{"[::1]:8080:[fe80::1]:80", "[::1]:8080", "[fe80::1]:80", false},
+		{"8080:[::1]:80", "localhost:8080", "[::1]:80", false},
+		{"", "", "", true},
+		{"8080", "", "", true},
+		{"8080:host", "", "", true},
+		{"a:b:c:d:e", "", "", true},
+		{"8080:host:", "", "", true},
+		{":host:80", "", "", true},
+		{"8080::80", "", "", true},
+		{"[::1:8080:host:80", "", "", true},
+		{"[::1]x:8080:host:80", "", "", true},
+		{"8080:fe80::1:80", "", "", true},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("Parse(%q) error = %v, want error %v", tt.in, err, tt.err)
+			continue
+		}
+		if got.Listen != tt.listen || got.Connect != tt.connect {
+			t.Errorf("Parse(%q) = %+v, want {%s %s}", tt.in, got, tt.listen, tt.connect)
+		}
+	}
+}
+
+func TestPipe(t *testing.T) {
+	a1, a2 := net.Pipe()
+	b1, b2 := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		Pipe(a2, b1)
+		close(done)
+	}()
+
+	go func() {
+		a1.Write([]byte("ping"))
+		a1.Close()
+	}()
+	got, err := ioutil.ReadAll(b2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, []byte("ping")) {
+		t.Errorf("relayed %q", got)
+	}
+	b2.Close()
+	<-done
+}
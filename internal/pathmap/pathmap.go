@@ -0,0 +1,116 @@
+package pathmap
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Rule maps the local directory Local to Remote inside the sandbox.
+type Rule struct {
+	Local  string
+	Remote string
+
+	// translate command arguments below Local
+	TranslateArgs bool
+	// translate occurrences of Remote in the command output back to Local
+	TranslateOutput bool
+}
+
+// Mapper translates paths between the local machine and the sandbox.
+type Mapper struct {
+	rules []Rule
+}
+
+// Identity maps the local root to the sandbox root.
+var Identity = Mapper{
+	rules: []Rule{{Local: "/", Remote: "/"}},
+}
+
+func New(rules []Rule) (Mapper, error) {
+	if len(rules) == 0 {
+		return Identity, nil
+	}
+
+	m := Mapper{}
+	for _, r := range rules {
+		if !path.IsAbs(r.Local) || !path.IsAbs(r.Remote) {
+			return Mapper{}, errors.Errorf("path mapping %q -> %q must be absolute", r.Local, r.Remote)
+		}
+		r.Local = path.Clean(r.Local)
+		r.Remote = path.Clean(r.Remote)
+		m.rules = append(m.rules, r)
+	}
+	// most specific rule first
+	sort.SliceStable(m.rules, func(i, j int) bool {
+		return len(m.rules[i].Local) > len(m.rules[j].Local)
+	})
+	return m, nil
+}
+
+func (m Mapper) Rules() []Rule {
+	return m.rules
+}
+
+// IsIdentity reports whether the local root is used as sandbox root.
+func (m Mapper) IsIdentity() bool {
+	return len(m.rules) == 1 && m.rules[0].Local == "/" && m.rules[0].Remote == "/"
+}
+
+// ToRemote translates a local path, it fails if p is outside of every
+// mapped directory.
+func (m Mapper) ToRemote(p string) (string, error) {
+	if r, ok := m.find(p); ok {
+		return rebase(p, r.Local, r.Remote), nil
+	}
+	return "", errors.Errorf("%s is outside of all mapped paths", p)
+}
+
+// Args translates absolute local paths in args, including the value of
+// "--flag=/path" arguments, for rules with TranslateArgs set.
+func (m Mapper) Args(args []string) []string {
+	ret := make([]string, len(args))
+	for i, a := range args {
+		ret[i] = m.arg(a)
+	}
+	return ret
+}
+
+func (m Mapper) arg(a string) string {
+	prefix := ""
+	if strings.HasPrefix(a, "-") {
+		i := strings.IndexByte(a, '=')
+		if i < 0 {
+			return a
+		}
+		prefix, a = a[:i+1], a[i+1:]
+	}
+	if !path.IsAbs(a) {
+		return prefix + a
+	}
+	r, ok := m.find(a)
+	if !ok || !r.TranslateArgs {
+		return prefix + a
+	}
+	return prefix + rebase(a, r.Local, r.Remote)
+}
+
+func (m Mapper) find(p string) (Rule, bool) {
+	p = path.Clean(p)
+	for _, r := range m.rules {
+		if under(p, r.Local) {
+			return r, true
+		}
+	}
+	return Rule{}, false
+}
+
+func under(p, root string) bool {
+	return root == "/" || p == root || strings.HasPrefix(p, root+"/")
+}
+
+func rebase(p, from, to string) string {
+	return path.Join(to, strings.TrimPrefix(path.Clean(p), from))
+}
@@ -0,0 +1,104 @@
+package pathmap
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name     string
+		rules    []Rule
+		identity bool
+		first    string
+		err      bool
+	}{
+		{"empty is identity", nil, true, "/", false},
+		{"explicit identity", []Rule{{Local: "/", Remote: "/"}}, true, "/", false},
+		{"relative local", []Rule{{Local: "home", Remote: "/home"}}, false, "", true},
+		{"relative remote", []Rule{{Local: "/home", Remote: "home"}}, false, "", true},
+		{"cleaned", []Rule{{Local: "/home/u/", Remote: "/w//"}}, false, "/home/u", false},
+		{"most specific first", []Rule{{Local: "/a", Remote: "/x"}, {Local: "/a/b", Remote: "/y"}}, false, "/a/b", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := New(tt.rules)
+			if (err != nil) != tt.err {
+				t.Fatalf("New error = %v, want error %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if m.IsIdentity() != tt.identity {
+				t.Errorf("IsIdentity = %v, want %v", m.IsIdentity(), tt.identity)
+			}
+			if got := m.Rules()[0].Local; got != tt.first {
+				t.Errorf("first rule = %q, want %q", got, tt.first)
+			}
+		})
+	}
+}
+
+func TestToRemote(t *testing.T) {
+	m, err := New([]Rule{
+		{Local: "/home/u", Remote: "/work"},
+		{Local: "/home/u/src", Remote: "/src"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		in   string
+		want string
+		err  bool
+	}{
+		{"/home/u", "/work", false},
+		{"/home/u/", "/work", false},
+		{"/home/u/doc/a.txt", "/work/doc/a.txt", false},
+		{"/home/u/src/main.go", "/src/main.go", false},
+		{"/home/u/../v", "", true},
+		{"/home/user", "", true},
+		{"/etc", "", true},
+	}
+	for _, tt := range tests {
+		got, err := m.ToRemote(tt.in)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("ToRemote(%q) = %q, %v; want %q, error %v", tt.in, got, err, tt.want, tt.err)
+		}
+	}
+
+	if got, _ := Identity.ToRemote("/a/b"); got != "/a/b" {
+		t.Errorf("Identity.ToRemote = %q", got)
+	}
+}
+
+func TestArgs(t *testing.T) {
+	m, err := New([]Rule{
+		{Local: "/home/u", Remote: "/work", TranslateArgs: true},
+		{Local: "/data", Remote: "/d"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		in, want string
+	}{
+		{"/home/u/a", "/work/a"},
+		{"--out=/home/u/b", "--out=/work/b"},
+		{"-o=/home/u", "-o=/work"},
+		{"--flag", "--flag"},
+		{"-I/home/u", "-I/home/u"},
+		{"relative/home/u", "relative/home/u"},
+		{"/data/x", "/data/x"},
+		{"/elsewhere", "/elsewhere"},
+		{"--empty=", "--empty="},
+	}
+	var in, want []string
+	for _, tt := range tests {
+		in = append(in, tt.in)
+		want = append(want, tt.want)
+	}
+	if got := m.Args(in); !reflect.DeepEqual(got, want) {
+		t.Errorf("Args = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,143 @@
+package pathmap
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+)
+
+// flushDelay is how long bytes that might be the beginning of a path are
+// held back, interactive output such as a PTY echoing "/" must not wait for
+// the next write.
+const flushDelay = 20 * time.Millisecond
+
+type outputRule struct {
+	remote []byte
+	local  []byte
+}
+
+// outputWriter replaces sandbox paths in the output with the local ones.
+// Bytes that might be the beginning of a path are held back until the next
+// write or flushDelay, so paths split across writes are still translated.
+type outputWriter struct {
+	w     io.Writer
+	rules []outputRule
+
+	mu    sync.Mutex
+	held  []byte
+	prev  byte
+	timer *time.Timer
+}
+
+// OutputWriter returns a writer translating the remote roots of rules with
+// TranslateOutput to local paths. Close flushes the held back bytes.
+func (m Mapper) OutputWriter(w io.Writer) io.WriteCloser {
+	ow := &outputWriter{w: w}
+	for _, r := range m.rules {
+		if r.TranslateOutput && r.Remote != "/" && r.Remote != r.Local {
+			ow.rules = append(ow.rules, outputRule{[]byte(r.Remote), []byte(r.Local)})
+		}
+	}
+	return ow
+}
+
+func (o *outputWriter) Write(p []byte) (int, error) {
+	if len(o.rules) == 0 {
+		return o.w.Write(p)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.timer != nil {
+		o.timer.Stop()
+		o.timer = nil
+	}
+	data := append(o.held, p...)
+	o.held = nil
+
+	var out bytes.Buffer
+	i := 0
+scan:
+	for i < len(data) {
+		c := data[i]
+		if c != '/' || isPathByte(o.prev) {
+			out.WriteByte(c)
+			o.prev = c
+			i++
+			continue
+		}
+		for _, r := range o.rules {
+			rest := data[i:]
+			if len(rest) <= len(r.remote) && bytes.HasPrefix(r.remote, rest) {
+				// could still become a match
+				o.held = append([]byte(nil), rest...)
+				break scan
+			}
+			if bytes.HasPrefix(rest, r.remote) {
+				next := rest[len(r.remote)]
+				if next == '/' || !isPathByte(next) {
+					out.Write(r.local)
+					o.prev = r.local[len(r.local)-1]
+					i += len(r.remote)
+					continue scan
+				}
+			}
+		}
+		out.WriteByte(c)
+		o.prev = c
+		i++
+	}
+
+	if _, err := o.w.Write(out.Bytes()); err != nil {
+		return 0, err
+	}
+	if len(o.held) != 0 {
+		var t *time.Timer
+		t = time.AfterFunc(flushDelay, func() {
+			o.mu.Lock()
+			defer o.mu.Unlock()
+			// a later write already took over the held bytes
+			if o.timer == t {
+				o.timer = nil
+				o.flush()
+			}
+		})
+		o.timer = t
+	}
+	return len(p), nil
+}
+
+func (o *outputWriter) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.timer != nil {
+		o.timer.Stop()
+		o.timer = nil
+	}
+	return o.flush()
+}
+
+// flush writes the held back bytes, translated if they are a complete
+// remote root.
+func (o *outputWriter) flush() error {
+	if len(o.held) == 0 {
+		return nil
+	}
+	held := o.held
+	for _, r := range o.rules {
+		if bytes.Equal(held, r.remote) {
+			held = r.local
+			break
+		}
+	}
+	o.prev = held[len(held)-1]
+	_, err := o.w.Write(held)
+	o.held = nil
+	return err
+}
+
+func isPathByte(c byte) bool {
+	return c == '/' || c == '.' || c == '_' || c == '-' ||
+		(c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
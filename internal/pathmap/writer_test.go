@@ -0,0 +1,110 @@
+package pathmap
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe to use from the flush timer.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestOutputWriter(t *testing.T) {
+	m, err := New([]Rule{
+		{Local: "/home/u", Remote: "/work", TranslateOutput: true},
+		{Local: "/data", Remote: "/d"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		writes []string
+		want   string
+	}{
+		{"plain", []string{"hello\n"}, "hello\n"},
+		{"path", []string{"open /work/a.go\n"}, "open /home/u/a.go\n"},
+		{"root alone", []string{"cd /work\n"}, "cd /home/u\n"},
+		{"root at end", []string{"cd /work"}, "cd /home/u"},
+		{"longer name", []string{"/workspace\n"}, "/workspace\n"},
+		{"inside other path", []string{"/x/work/a\n"}, "/x/work/a\n"},
+		{"after word", []string{"a/work/b\n"}, "a/work/b\n"},
+		{"without TranslateOutput", []string{"/d/x\n"}, "/d/x\n"},
+		{"split in prefix", []string{"file /wo", "rk/a\n"}, "file /home/u/a\n"},
+		{"split after slash", []string{"file /", "work/a\n"}, "file /home/u/a\n"},
+		{"split after root", []string{"file /work", "/a\n"}, "file /home/u/a\n"},
+		{"split byte by byte", []string{"/", "w", "o", "r", "k", "/", "a"}, "/home/u/a"},
+		{"split prefix not matching", []string{"/wo", "od\n"}, "/wood\n"},
+		{"held prefix at close", []string{"x /wo"}, "x /wo"},
+		{"several", []string{"/work/a /work/b\n"}, "/home/u/a /home/u/b\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out syncBuffer
+			w := m.OutputWriter(&out)
+			for _, s := range tt.writes {
+				if n, err := w.Write([]byte(s)); err != nil || n != len(s) {
+					t.Fatalf("Write(%q) = %d, %v", s, n, err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if got := out.String(); got != tt.want {
+				t.Errorf("output = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutputWriterFlushesHeldBytes(t *testing.T) {
+	m, err := New([]Rule{{Local: "/home/u", Remote: "/work", TranslateOutput: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out syncBuffer
+	w := m.OutputWriter(&out)
+	w.Write([]byte("$ ls /"))
+	if got := out.String(); got != "$ ls " {
+		t.Fatalf("output before flush = %q", got)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for out.String() != "$ ls /" {
+		if time.Now().After(deadline) {
+			t.Fatalf("held bytes not flushed, output %q", out.String())
+		}
+		time.Sleep(flushDelay)
+	}
+	w.Write([]byte("work\n"))
+	w.Close()
+	if got := out.String(); got != "$ ls /work\n" {
+		t.Errorf("output = %q", got)
+	}
+}
+
+func TestOutputWriterIdentity(t *testing.T) {
+	var out bytes.Buffer
+	w := Identity.OutputWriter(&out)
+	w.Write([]byte("/a /"))
+	w.Close()
+	if out.String() != "/a /" {
+		t.Errorf("output = %q", out.String())
+	}
+}
@@ -57,6 +57,18 @@ func (n *CommandChan) RecvNotification() <-chan *Notification {
 	return c
 }
 
+// NextNotification reads a single notification, unlike RecvNotification it
+// leaves the data following it to Read.
+func (n *CommandChan) NextNotification() (*Notification, error) {
+	s, err := n.r.ReadBytes('\x00')
+	if err != nil {
+		return nil, err
+	}
+	var resp Notification
+	err = json.Unmarshal(s[:len(s)-1], &resp)
+	return &resp, err
+}
+
 func (n *CommandChan) SendNotification(r *Notification) error {
 	req, err := json.Marshal(r)
 	if err != nil {
@@ -69,3 +81,14 @@ func (n *CommandChan) SendNotification(r *Notification) error {
 func (n *CommandChan) Close() error {
 	return n.w.Close()
 }
+
+// Read reads raw data following the messages, for streams that carry a
+// request header before their payload.
+func (n *CommandChan) Read(p []byte) (int, error) {
+	return n.r.Read(p)
+}
+
+// Write writes raw data, see Read.
+func (n *CommandChan) Write(p []byte) (int, error) {
+	return n.w.Write(p)
+}
@@ -0,0 +1,84 @@
+package protocol
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/smux"
+)
+
+// Conn is a client connection to rexecd. The first stream of the smux
+// session carries the request and notifications, the daemon handles a single
+// request per connection.
+type Conn struct {
+	sock net.Conn
+	sess *smux.Session
+	cmd  *CommandChan
+}
+
+// Dial connects to the daemon listening on socketPath.
+func Dial(socketPath string) (*Conn, error) {
+	sock, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to daemon")
+	}
+	return NewConn(sock)
+}
+
+// NewConn talks to the daemon over an established connection, it is closed
+// with the returned Conn.
+func NewConn(sock net.Conn) (*Conn, error) {
+	sess, err := smux.Client(sock, nil)
+	if err != nil {
+		sock.Close()
+		return nil, errors.Wrap(err, "failed to create smux session")
+	}
+
+	cmdStream, err := sess.OpenStream()
+	if err != nil {
+		sess.Close()
+		sock.Close()
+		return nil, errors.Wrap(err, "failed to open command stream")
+	}
+
+	return &Conn{
+		sock: sock,
+		sess: sess,
+		cmd:  NewCommandChan(cmdStream),
+	}, nil
+}
+
+// Request sends req to the daemon and returns the notifications it sends
+// back. The channel is closed when the daemon is done with the request.
+func (c *Conn) Request(req *Request) (<-chan *Notification, error) {
+	if err := c.cmd.SendRequest(req); err != nil {
+		return nil, errors.Wrap(err, "failed to send request")
+	}
+	return c.cmd.RecvNotification(), nil
+}
+
+// SendNotification sends n to the daemon, e.g. window changes of a running
+// command.
+func (c *Conn) SendNotification(n *Notification) error {
+	return c.cmd.SendNotification(n)
+}
+
+// CommandChan returns the first stream, for requests that use it for more
+// than notifications.
+func (c *Conn) CommandChan() *CommandChan {
+	return c.cmd
+}
+
+func (c *Conn) OpenStream() (*smux.Stream, error) {
+	return c.sess.OpenStream()
+}
+
+func (c *Conn) AcceptStream() (*smux.Stream, error) {
+	return c.sess.AcceptStream()
+}
+
+func (c *Conn) Close() error {
+	c.cmd.Close()
+	c.sess.Close()
+	return c.sock.Close()
+}
@@ -1,31 +1,271 @@
 package protocol
 
+import (
+	"os"
+	"time"
+
+	"github.com/brian14708/rexec/internal/sandbox"
+)
+
 type Request struct {
-	Exec *ExecRequest
+	Exec   *ExecRequest
+	Jobs   *JobsRequest
+	Attach *AttachRequest
+	Logs   *LogsRequest
+	Kill   *KillRequest
+	Status *StatusRequest
+
+	Forward *ForwardRequest
+	Dial    *DialRequest
+	Copy    *CopyRequest
 }
 
+// AutoServer selects the least loaded server matching ExecRequest.Labels.
+const AutoServer = "auto"
+
 type ExecRequest struct {
+	Server string
+	// constraints on the server chosen by AutoServer
+	Labels map[string]string
+	Detach bool
+	// name of a profile in the config, its settings apply where the
+	// request leaves them unset
+	Profile string
+
 	Command    string
 	Args       []string
 	WorkingDir string
 	Env        []string
+	// set explicitly by the user, bypasses the forwarding policy
+	ExtraEnv []string
 
 	DisablePTY    bool
 	TerminalName  string
 	TerminalCols  int
 	TerminalLines int
+
+	RemoteForward []RemoteForward
+
+	// zero uses the server default
+	Timeout     time.Duration
+	IdleTimeout time.Duration
+	// can only tighten the configured limits
+	Limits sandbox.Limits
+
+	// run in a copy of the working directory, nil uses the server default
+	Sync *bool
+	// added to the outputs copied back in sync mode
+	SyncOutputs []string
+}
+
+// RemoteForward listens on Listen on the server while the command runs, the
+// daemon opens a stream for every connection, starting with a DialRequest
+// for Connect, which the client dials locally.
+type RemoteForward struct {
+	Listen  string
+	Connect string
+}
+
+type JobsRequest struct {
+}
+
+type AttachRequest struct {
+	// empty selects the latest running job without clients
+	ID string
+}
+
+type LogsRequest struct {
+	ID string
+}
+
+type KillRequest struct {
+	ID string
+	// defaults to "TERM"
+	Signal string
+}
+
+type StatusRequest struct {
+}
+
+// ForwardRequest starts a port forwarding session to a server. Every further
+// stream the client opens on the session starts with a DialRequest followed
+// by the raw connection data.
+type ForwardRequest struct {
+	Server string
+	// the server of the profile is used if Server is empty, like for
+	// ExecRequest
+	Profile string
+}
+
+type DialRequest struct {
+	Network string
+	Address string
+}
+
+// Copy operations, see CopyRequest.
+const (
+	// Files of Path, recursively if Recursive is set, none if Path does not
+	// exist
+	CopyList = "list"
+	// create the directory Path with Mode
+	CopyMkdir = "mkdir"
+	// set Mode and ModTime of Path
+	CopySetAttr = "setattr"
+	// upload Size bytes to Path, the daemon replies with a Transfer telling
+	// the offset to resume at, the client then sends the remaining data
+	CopyPut = "put"
+	// download Path starting at Offset, the daemon replies with a Transfer
+	// describing the file followed by the data
+	CopyGet = "get"
+)
+
+// CopyRequest is a file operation on a server. The first stream of a copy
+// session names the server, every further stream the client opens starts
+// with a CopyRequest for the same server.
+type CopyRequest struct {
+	Server string
+	Op     string
+	Path   string
+
+	Recursive bool
+	Size      int64
+	Offset    int64
+	Mode      os.FileMode
+	ModTime   time.Time
+}
+
+type FileInfo struct {
+	// relative to the listed path, "." for the path itself
+	Path    string
+	Size    int64
+	Mode    os.FileMode
+	ModTime time.Time
+}
+
+type TransferInfo struct {
+	Offset int64
+	File   FileInfo
+	// sent once all data was written
+	Done bool
 }
 
 type Notification struct {
 	WindowChange *WindowChange
 	Exit         *ExitStatus
+	Error        *Error
+	Signal       *Signal
+	Connected    *ServerConnected
+	Job          *JobInfo
+	Jobs         []JobInfo
+	Status       *StatusReport
+	Files        []FileInfo
+	Transfer     *TransferInfo
+}
+
+// ServerConnected is sent for exec requests once the server that runs the
+// command is connected, before the job is reported.
+type ServerConnected struct {
+	Server string
+	// time it took to connect and mount the connection in use, it may have
+	// been established for an earlier request
+	Latency time.Duration
+}
+
+// Signal names follow RFC 4254 without the "SIG" prefix, e.g. "INT".
+type Signal struct {
+	Name string
+}
+
+type Error struct {
+	Message string
 }
 
+// Error categories of ExitStatus
+const (
+	ErrorConnect    = "connect-failed"
+	ErrorMount      = "mount-failed"
+	ErrorSpawn      = "spawn-failed"
+	ErrorRemoteExit = "remote-exit"
+)
+
+// Timeouts of ExitStatus
+const (
+	TimeoutTotal = "timeout"
+	TimeoutIdle  = "idle-timeout"
+)
+
 type ExitStatus struct {
+	// shell compatible, 128+n for processes terminated by signal n, 124 for
+	// timeouts and 255 if the command could not be run
 	ExitCode int
+	// only set when the remote side reports the signal, a sandboxed process
+	// killed by a signal may just exit with 128+n since that cannot be told
+	// apart from exiting with that code
+	Signal     string
+	CoreDumped bool
+	Error      string
+	Category   string
+	// set when the process was terminated for reaching a timeout
+	Timeout string
+	// set with Timeout when the process did not exit on SIGTERM within the
+	// grace period, or SIGTERM could not be delivered, and was killed
+	Killed bool
+	// set when the process was killed for exceeding a resource limit, e.g.
+	// "memory"
+	Limit string
+	// limits only approximated by rlimits since the server has no systemd
+	// scope enforcing them, see sandbox.Limits
+	ApproximatedLimits []string
 }
 
 type WindowChange struct {
 	TerminalCols  int
 	TerminalLines int
 }
+
+type JobInfo struct {
+	ID       string
+	Server   string
+	Command  string
+	Args     []string
+	Started  time.Time
+	Detached bool
+	PTY      bool
+	PID      int
+	Client   string
+	Clients  int
+
+	// nil while the job is running
+	Exit *ExitStatus
+}
+
+type StatusReport struct {
+	Started  time.Time
+	Uptime   time.Duration
+	Servers  []ServerStatus
+	Sessions []JobInfo
+	// when the config in use was loaded, a failed reload keeps it and sets
+	// ConfigError
+	ConfigLoaded time.Time
+	ConfigError  string
+}
+
+type ServerStatus struct {
+	Name       string
+	Host       string
+	Labels     map[string]string
+	Connection string
+	Mount      string
+	Error      string
+	// next reconnect attempt, zero while connected and mounted
+	Retry time.Time
+	// nil until the first successful sample
+	Load *ServerLoad
+}
+
+type ServerLoad struct {
+	Load1        float64
+	CPUs         int
+	MemAvailable int64
+	Sampled      time.Time
+}
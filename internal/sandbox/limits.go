@@ -0,0 +1,215 @@
+package sandbox
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Limits caps the resources of a sandboxed command, zero means unlimited.
+// Memory, CPU and Tasks apply to the whole process tree when a systemd user
+// scope enforces them. Without a scope they are only approximated by rlimits
+// of every process: Memory caps the address space of each process, Tasks
+// counts all processes of the user on the server and CPU becomes a CPU time
+// of CPU times the timeout of the command. Files is always an rlimit.
+type Limits struct {
+	Memory ByteSize
+	// number of CPUs, may be fractional
+	CPU float64
+	// processes and threads, exceeding it makes fork fail
+	Tasks int
+	// open file descriptors
+	Files int
+}
+
+// Override returns l with the fields set in o replaced.
+func (l Limits) Override(o Limits) Limits {
+	if o.Memory != 0 {
+		l.Memory = o.Memory
+	}
+	if o.CPU != 0 {
+		l.CPU = o.CPU
+	}
+	if o.Tasks != 0 {
+		l.Tasks = o.Tasks
+	}
+	if o.Files != 0 {
+		l.Files = o.Files
+	}
+	return l
+}
+
+// Tighten returns l with the fields set in o lowered to o, limits can only
+// get stricter.
+func (l Limits) Tighten(o Limits) Limits {
+	if o.Memory != 0 && (l.Memory == 0 || o.Memory < l.Memory) {
+		l.Memory = o.Memory
+	}
+	if o.CPU != 0 && (l.CPU == 0 || o.CPU < l.CPU) {
+		l.CPU = o.CPU
+	}
+	if o.Tasks != 0 && (l.Tasks == 0 || o.Tasks < l.Tasks) {
+		l.Tasks = o.Tasks
+	}
+	if o.Files != 0 && (l.Files == 0 || o.Files < l.Files) {
+		l.Files = o.Files
+	}
+	return l
+}
+
+func (l Limits) IsZero() bool {
+	return l == Limits{}
+}
+
+// NeedsScope reports whether l can only be enforced exactly by a systemd
+// scope.
+func (l Limits) NeedsScope() bool {
+	return l.Memory > 0 || l.CPU > 0 || l.Tasks > 0
+}
+
+// Approximated returns the names of the limits that rlimits only
+// approximate.
+func (l Limits) Approximated() []string {
+	var names []string
+	if l.Memory > 0 {
+		names = append(names, "memory")
+	}
+	if l.CPU > 0 {
+		names = append(names, "cpu")
+	}
+	if l.Tasks > 0 {
+		names = append(names, "tasks")
+	}
+	return names
+}
+
+// Controllers returns the cgroup controllers a systemd scope needs to
+// enforce l, without them the scope runs the command unlimited.
+func (l Limits) Controllers() []string {
+	var names []string
+	if l.Memory > 0 {
+		names = append(names, "memory")
+	}
+	if l.CPU > 0 {
+		names = append(names, "cpu")
+	}
+	if l.Tasks > 0 {
+		names = append(names, "pids")
+	}
+	return names
+}
+
+// Set parses a single limit given as key and value, e.g. "memory" and "4G".
+func (l *Limits) Set(key, value string) error {
+	var err error
+	switch strings.ToLower(key) {
+	case "memory":
+		err = l.Memory.UnmarshalText([]byte(value))
+	case "cpu":
+		l.CPU, err = strconv.ParseFloat(value, 64)
+	case "tasks":
+		l.Tasks, err = strconv.Atoi(value)
+	case "files":
+		l.Files, err = strconv.Atoi(value)
+	default:
+		return fmt.Errorf("unknown limit: %s", key)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "invalid %s limit", key)
+	}
+	return nil
+}
+
+// ScopeCheck is a command that fails if no systemd user scope can be created
+// and prints the cgroup controllers delegated to the user manager otherwise,
+// see Controllers.
+var ScopeCheck = []string{"/bin/sh", "-c", `systemd-run --user --scope --quiet true || exit
+cat "/sys/fs/cgroup$(systemctl show -p ControlGroup --value "user@$(id -u).service")/cgroup.controllers"`}
+
+// wrapper returns the command prefix enforcing l. With unit, the limits of
+// the process tree are enforced by a systemd scope of that name, otherwise
+// they are approximated by rlimits and the CPU limit by a CPU time over
+// timeout.
+func (l Limits) wrapper(unit string, timeout time.Duration) []string {
+	var script []string
+	if l.Files > 0 {
+		script = append(script, fmt.Sprintf("ulimit -n %d", l.Files))
+	}
+
+	var props []string
+	if l.Memory > 0 {
+		props = append(props, fmt.Sprintf("-p MemoryMax=%d", l.Memory))
+	}
+	if l.CPU > 0 {
+		// CPUQuota has a resolution of 1%, 0% would not limit at all
+		quota := int(math.Round(l.CPU * 100))
+		if quota < 1 {
+			quota = 1
+		}
+		props = append(props, fmt.Sprintf("-p CPUQuota=%d%%", quota))
+	}
+	if l.Tasks > 0 {
+		props = append(props, fmt.Sprintf("-p TasksMax=%d", l.Tasks))
+	}
+	run := `exec "$@"`
+	switch {
+	case len(props) == 0:
+	case unit != "":
+		run = fmt.Sprintf("exec systemd-run --user --scope --quiet --unit=%s %s -- \"$@\"",
+			unit, strings.Join(props, " "))
+	default:
+		if l.Memory > 0 {
+			script = append(script, fmt.Sprintf("ulimit -v %d", (l.Memory+1023)/1024))
+		}
+		if l.Tasks > 0 {
+			script = append(script, fmt.Sprintf("{ ulimit -u %d || ulimit -p %d; } 2>/dev/null", l.Tasks, l.Tasks))
+		}
+		if l.CPU > 0 && timeout > 0 {
+			script = append(script, fmt.Sprintf("ulimit -t %d", int64(math.Ceil(l.CPU*timeout.Seconds()))))
+		}
+	}
+	script = append(script, run)
+	return []string{"/bin/sh", "-c", strings.Join(script, "\n"), "rexec-limits"}
+}
+
+// ByteSize is a number of bytes, in text it may have a K, M, G or T suffix
+// with powers of 1024.
+type ByteSize int64
+
+// MarshalText writes the plain number of bytes, JSON would otherwise encode
+// a number that UnmarshalText does not accept.
+func (b ByteSize) MarshalText() ([]byte, error) {
+	return []byte(strconv.FormatInt(int64(b), 10)), nil
+}
+
+func (b *ByteSize) UnmarshalText(text []byte) error {
+	s := strings.TrimSpace(string(text))
+	s = strings.TrimSuffix(strings.ToUpper(s), "B")
+	s = strings.TrimSuffix(s, "I")
+	mult := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		case 'T':
+			mult = 1 << 40
+		}
+		if mult != 1 {
+			s = s[:n-1]
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return fmt.Errorf("invalid size: %s", text)
+	}
+	*b = ByteSize(v * float64(mult))
+	return nil
+}
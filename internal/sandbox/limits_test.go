@@ -0,0 +1,164 @@
+package sandbox
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestByteSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want ByteSize
+		err  bool
+	}{
+		{"0", 0, false},
+		{"512", 512, false},
+		{"1K", 1 << 10, false},
+		{"1k", 1 << 10, false},
+		{"2M", 2 << 20, false},
+		{"4G", 4 << 30, false},
+		{"1T", 1 << 40, false},
+		{"1GB", 1 << 30, false},
+		{"1GiB", 1 << 30, false},
+		{"1.5G", 3 << 29, false},
+		{" 8M ", 8 << 20, false},
+		{"100B", 100, false},
+		{"", 0, true},
+		{"G", 0, true},
+		{"-1G", 0, true},
+		{"1X", 0, true},
+		{"1 G", 0, true},
+		{"abc", 0, true},
+	}
+	for _, tt := range tests {
+		var b ByteSize
+		err := b.UnmarshalText([]byte(tt.in))
+		if (err != nil) != tt.err || (err == nil && b != tt.want) {
+			t.Errorf("UnmarshalText(%q) = %d, %v; want %d, error %v", tt.in, b, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestLimitsJSON(t *testing.T) {
+	for _, l := range []Limits{{}, {Memory: 1 << 30, CPU: 0.5, Tasks: 10, Files: 64}} {
+		b, err := json.Marshal(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Limits
+		if err := json.Unmarshal(b, &got); err != nil || got != l {
+			t.Errorf("round trip of %+v through %s = %+v, %v", l, b, got, err)
+		}
+	}
+}
+
+func TestLimitsSet(t *testing.T) {
+	tests := []struct {
+		key, value string
+		want       Limits
+		err        bool
+	}{
+		{"memory", "1G", Limits{Memory: 1 << 30}, false},
+		{"Memory", "512M", Limits{Memory: 512 << 20}, false},
+		{"cpu", "1.5", Limits{CPU: 1.5}, false},
+		{"tasks", "64", Limits{Tasks: 64}, false},
+		{"files", "1024", Limits{Files: 1024}, false},
+		{"memory", "lots", Limits{}, true},
+		{"cpu", "x", Limits{}, true},
+		{"tasks", "1.5", Limits{}, true},
+		{"disk", "1G", Limits{}, true},
+	}
+	for _, tt := range tests {
+		var l Limits
+		err := l.Set(tt.key, tt.value)
+		if (err != nil) != tt.err || (err == nil && l != tt.want) {
+			t.Errorf("Set(%q, %q) = %+v, %v; want %+v, error %v", tt.key, tt.value, l, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestLimitsOverrideTighten(t *testing.T) {
+	base := Limits{Memory: 4 << 30, CPU: 2, Tasks: 100}
+	tests := []struct {
+		name string
+		got  Limits
+		want Limits
+	}{
+		{"override empty", base.Override(Limits{}), base},
+		{"override some", base.Override(Limits{CPU: 4, Files: 10}), Limits{Memory: 4 << 30, CPU: 4, Tasks: 100, Files: 10}},
+		{"tighten empty", base.Tighten(Limits{}), base},
+		{"tighten lower", base.Tighten(Limits{Memory: 1 << 30, Tasks: 10}), Limits{Memory: 1 << 30, CPU: 2, Tasks: 10}},
+		{"tighten cannot raise", base.Tighten(Limits{Memory: 8 << 30, CPU: 8}), base},
+		{"tighten unlimited", Limits{}.Tighten(Limits{Files: 10}), Limits{Files: 10}},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestLimitsWrapper(t *testing.T) {
+	tests := []struct {
+		name    string
+		limits  Limits
+		unit    string
+		timeout time.Duration
+		scope   bool
+		want    []string
+		notWant []string
+	}{
+		{"files only", Limits{Files: 64}, "u", 0, false, []string{"ulimit -n 64", `exec "$@"`}, []string{"systemd-run"}},
+		{"memory", Limits{Memory: 1 << 20}, "u", 0, true, []string{"exec systemd-run --user --scope --quiet --unit=u -p MemoryMax=1048576 --"}, []string{"ulimit", `exec "$@"`}},
+		{"cpu", Limits{CPU: 1.5}, "u", 0, true, []string{"-p CPUQuota=150%"}, nil},
+		{"cpu rounded", Limits{CPU: 0.07}, "u", 0, true, []string{"-p CPUQuota=7%"}, nil},
+		{"cpu at least 1%", Limits{CPU: 0.001}, "u", 0, true, []string{"-p CPUQuota=1%"}, []string{"CPUQuota=0%"}},
+		{"tasks", Limits{Tasks: 8}, "u", 0, true, []string{"-p TasksMax=8"}, []string{"ulimit"}},
+		{"all", Limits{Memory: 1, CPU: 1, Tasks: 1, Files: 1}, "u", 0, true, []string{"ulimit -n 1\nexec systemd-run"}, nil},
+		{"fallback memory", Limits{Memory: 1 << 20}, "", 0, true, []string{"ulimit -v 1024", `exec "$@"`}, []string{"systemd-run"}},
+		{"fallback tasks", Limits{Tasks: 8}, "", 0, true, []string{"ulimit -u 8"}, []string{"systemd-run"}},
+		{"fallback cpu", Limits{CPU: 0.5}, "", time.Minute, true, []string{"ulimit -t 30"}, []string{"systemd-run"}},
+		{"fallback cpu without timeout", Limits{CPU: 0.5}, "", 0, true, []string{`exec "$@"`}, []string{"ulimit -t"}},
+	}
+	for _, tt := range tests {
+		if got := tt.limits.NeedsScope(); got != tt.scope {
+			t.Errorf("%s: NeedsScope = %v, want %v", tt.name, got, tt.scope)
+		}
+		w := tt.limits.wrapper(tt.unit, tt.timeout)
+		if len(w) != 4 || w[0] != "/bin/sh" || w[1] != "-c" {
+			t.Fatalf("%s: wrapper = %q", tt.name, w)
+		}
+		for _, s := range tt.want {
+			if !strings.Contains(w[2], s) {
+				t.Errorf("%s: script %q does not contain %q", tt.name, w[2], s)
+			}
+		}
+		for _, s := range tt.notWant {
+			if strings.Contains(w[2], s) {
+				t.Errorf("%s: script %q contains %q", tt.name, w[2], s)
+			}
+		}
+	}
+}
+
+func TestLimitsControllers(t *testing.T) {
+	tests := []struct {
+		limits       Limits
+		controllers  string
+		approximated string
+	}{
+		{Limits{Files: 10}, "", ""},
+		{Limits{Memory: 1}, "memory", "memory"},
+		{Limits{Memory: 1, CPU: 1, Tasks: 1, Files: 1}, "memory cpu pids", "memory cpu tasks"},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(tt.limits.Controllers(), " "); got != tt.controllers {
+			t.Errorf("%+v: Controllers = %q, want %q", tt.limits, got, tt.controllers)
+		}
+		if got := strings.Join(tt.limits.Approximated(), " "); got != tt.approximated {
+			t.Errorf("%+v: Approximated = %q, want %q", tt.limits, got, tt.approximated)
+		}
+	}
+}
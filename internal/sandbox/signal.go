@@ -0,0 +1,30 @@
+package sandbox
+
+// signalScript sends signal $1 to the command of the sandbox whose bwrap
+// info is in $0. bwrap does not forward signals, a signal sent to it kills
+// the sandbox instead of reaching the command. With a PID namespace the
+// sandbox child is the init of bwrap and the command its child.
+const signalScript = `pid=$(sed -n 's/.*"child-pid": *\([0-9][0-9]*\).*/\1/p' "$0")
+if [ -z "$pid" ]; then
+	echo "sandbox not started" >&2
+	exit 1
+fi
+if [ "$2" = 1 ]; then
+	pid=$(pgrep -P "$pid")
+	if [ -z "$pid" ]; then
+		echo "command not running" >&2
+		exit 1
+	fi
+fi
+exec kill -s "$1" $pid`
+
+// SignalArgs returns a command delivering sig, e.g. "INT", to the command
+// running in the sandbox. It needs InfoFile and runs on the same host as
+// the sandbox.
+func (s *Spec) SignalArgs(sig string) []string {
+	unshared := "0"
+	if s.UnshareNamespace {
+		unshared = "1"
+	}
+	return []string{"/bin/sh", "-c", signalScript, s.InfoFile, sig, unshared}
+}
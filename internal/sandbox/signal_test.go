@@ -0,0 +1,100 @@
+package sandbox
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// trapped is a command that reports a SIGINT from its trap handler.
+const trapped = `trap 'echo trapped; exit 0' INT; echo ready; while :; do sleep 0.05; done`
+
+func TestSignalArgs(t *testing.T) {
+	tests := []struct {
+		name     string
+		unshared bool
+		// what bwrap reports as child-pid, the command itself or a parent
+		// standing in for the init of a PID namespace
+		args []string
+	}{
+		{"command", false, []string{"-c", trapped}},
+		{"below init", true, []string{"-c", `sh -c "$0"; echo init done`, trapped}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "rexec-signal")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			cmd := exec.Command("sh", tt.args...)
+			stdout, err := cmd.StdoutPipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer cmd.Process.Kill()
+			out := bufio.NewReader(stdout)
+			if line, _ := out.ReadString('\n'); line != "ready\n" {
+				t.Fatalf("command printed %q", line)
+			}
+
+			// the format of bwrap --info-fd
+			s := &Spec{UnshareNamespace: tt.unshared, InfoFile: filepath.Join(dir, "info")}
+			info := fmt.Sprintf("{\n    \"child-pid\": %d\n}\n", cmd.Process.Pid)
+			if err := ioutil.WriteFile(s.InfoFile, []byte(info), 0600); err != nil {
+				t.Fatal(err)
+			}
+			args := s.SignalArgs("INT")
+			if b, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+				t.Fatalf("signal failed: %v: %s", err, b)
+			}
+
+			done := make(chan error, 1)
+			go func() {
+				b, _ := ioutil.ReadAll(out)
+				if !strings.HasPrefix(string(b), "trapped\n") {
+					done <- fmt.Errorf("handler did not run, output %q", b)
+					return
+				}
+				done <- cmd.Wait()
+			}()
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("command did not exit")
+			}
+		})
+	}
+}
+
+func TestSignalArgsNotStarted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rexec-signal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// CommandArgs creates the file, bwrap fills it once the sandbox runs
+	s := &Spec{InfoFile: filepath.Join(dir, "info")}
+	if err := ioutil.WriteFile(s.InfoFile, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	args := s.SignalArgs("INT")
+	b, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err == nil || !strings.Contains(string(b), "sandbox not started") {
+		t.Fatalf("signal before start = %v, %q", err, b)
+	}
+}
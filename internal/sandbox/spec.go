@@ -3,6 +3,7 @@ package sandbox
 import (
 	"fmt"
 	"sort"
+	"time"
 )
 
 type BindType int
@@ -24,6 +25,17 @@ type Spec struct {
 
 	Bind             []BindSpec
 	UnshareNamespace bool
+
+	Limits Limits
+	// name of the systemd scope enforcing Limits, empty to approximate them
+	// with rlimits
+	LimitScope string
+	// timeout of the command, the rlimit fallback turns the CPU limit into
+	// a CPU time over it
+	LimitTimeout time.Duration
+	// file CommandArgs makes bwrap write the PID of the sandbox to, see
+	// SignalArgs
+	InfoFile string
 }
 
 type BindSpec struct {
@@ -33,6 +45,10 @@ type BindSpec struct {
 }
 
 func (s *Spec) commandArgs() (prefix []string, args []string, exe []string) {
+	if !s.Limits.IsZero() {
+		prefix = append(prefix, s.Limits.wrapper(s.LimitScope, s.LimitTimeout)...)
+	}
+
 	// env related
 	if s.UnshareNamespace {
 		prefix = append(prefix, "/usr/bin/env", "-i")
@@ -101,6 +117,7 @@ func (s *Spec) commandArgs() (prefix []string, args []string, exe []string) {
 	if s.UnshareNamespace {
 		args = append(args,
 			"--unshare-all",
+			// remote forwarded ports listen on the host network
 			"--share-net",
 			"--hostname", currentHostname,
 			"--uid", currentUid,
@@ -123,6 +140,10 @@ func (s *Spec) commandArgs() (prefix []string, args []string, exe []string) {
 
 func (s *Spec) CommandArgs() []string {
 	p, a, e := s.commandArgs()
+	if s.InfoFile != "" {
+		p = append([]string{"/bin/sh", "-c", `exec 3>"$0" && exec "$@"`, s.InfoFile}, p...)
+		a = append(a, "--info-fd", "3")
+	}
 	return append(append(p, a...), e...)
 }
 
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 	"golang.org/x/crypto/ssh/terminal"
@@ -80,6 +81,65 @@ func (c *Conn) Close() error {
 	return c.sshc.Close()
 }
 
+// Dial connects to addr from the remote host.
+func (c *Conn) Dial(network, addr string) (net.Conn, error) {
+	return c.sshc.Dial(network, addr)
+}
+
+// SFTP starts an SFTP session on the connection.
+func (c *Conn) SFTP() (*sftp.Client, error) {
+	return sftp.NewClient(c.sshc)
+}
+
+// Listen asks the remote host to listen on addr.
+func (c *Conn) Listen(network, addr string) (net.Listener, error) {
+	return c.sshc.Listen(network, addr)
+}
+
+// Wait blocks until the connection is closed.
+func (c *Conn) Wait() error {
+	return c.sshc.Wait()
+}
+
+// Keepalive sends a keepalive request every interval and closes the
+// connection if the server does not answer within timeout, until the
+// connection is closed.
+func (c *Conn) Keepalive(interval, timeout time.Duration) {
+	closed := make(chan struct{})
+	go func() {
+		c.sshc.Wait()
+		close(closed)
+	}()
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-closed:
+				return
+			case <-t.C:
+			}
+
+			reply := make(chan error, 1)
+			go func() {
+				_, _, err := c.sshc.SendRequest("keepalive@openssh.com", true, nil)
+				reply <- err
+			}()
+			select {
+			case err := <-reply:
+				if err == nil {
+					continue
+				}
+			case <-time.After(timeout):
+			case <-closed:
+				return
+			}
+			c.sshc.Close()
+			return
+		}
+	}()
+}
+
 func passwordAuth() ssh.AuthMethod {
 	return ssh.PasswordCallback(func() (string, error) {
 		fmt.Print("Enter password: ")
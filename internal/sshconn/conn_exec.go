@@ -1,74 +1,349 @@
 package sshconn
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/alessio/shellescape"
+	"github.com/pkg/errors"
 	"golang.org/x/crypto/ssh"
 )
 
+// Cmd is a command running in a ssh session channel. It is handled on the
+// channel level instead of through ssh.Session to get the complete exit
+// status of the remote process.
 type Cmd struct {
-	sess *ssh.Session
+	ch   ssh.Channel
+	reqs <-chan *ssh.Request
 	args string
+	pid  *pidWriter
+
+	stdinPipe  bool
+	stdoutPipe bool
+	stderrPipe bool
+
+	wg     sync.WaitGroup
+	exit   chan struct{}
+	status exitStatus
 
 	Stdin  io.Reader
 	Stdout io.Writer
 	Stderr io.Writer
+
+	// ReportPID makes the remote shell print its PID before running the
+	// command, it is stripped from stdout and available through PID.
+	ReportPID bool
+}
+
+// ExitError is returned by Wait if the remote command did not exit
+// successfully.
+type ExitError struct {
+	// shell compatible, 128+n for commands terminated by signal n
+	Status     int
+	Signal     string
+	CoreDumped bool
+	Msg        string
+}
+
+func (e *ExitError) Error() string {
+	if e.Signal != "" {
+		s := fmt.Sprintf("remote command terminated by signal %s", e.Signal)
+		if e.CoreDumped {
+			s += " (core dumped)"
+		}
+		if e.Msg != "" {
+			s += ": " + e.Msg
+		}
+		return s
+	}
+	return fmt.Sprintf("remote command exited with status %d", e.Status)
+}
+
+// ErrExitMissing is returned by Wait if the channel was closed without
+// reporting how the remote command exited, e.g. when the connection dies.
+var ErrExitMissing = errors.New("remote command exited without exit status or exit signal")
+
+type exitStatus struct {
+	status     int
+	hasStatus  bool
+	signal     string
+	coreDumped bool
+	msg        string
+}
+
+// signal numbers on Linux
+var signalNumbers = map[ssh.Signal]int{
+	ssh.SIGHUP:  1,
+	ssh.SIGINT:  2,
+	ssh.SIGQUIT: 3,
+	ssh.SIGILL:  4,
+	"TRAP":      5,
+	ssh.SIGABRT: 6,
+	"BUS":       7,
+	ssh.SIGFPE:  8,
+	ssh.SIGKILL: 9,
+	ssh.SIGUSR1: 10,
+	ssh.SIGSEGV: 11,
+	ssh.SIGUSR2: 12,
+	ssh.SIGPIPE: 13,
+	ssh.SIGALRM: 14,
+	ssh.SIGTERM: 15,
+	"XCPU":      24,
+	"XFSZ":      25,
+	"SYS":       31,
+}
+
+// SignalNumber returns the Linux number of a signal name.
+func SignalNumber(sig ssh.Signal) (int, bool) {
+	n, ok := signalNumbers[sig]
+	return n, ok
+}
+
+func (c *Cmd) prepare() string {
+	if !c.ReportPID {
+		return c.args
+	}
+	c.pid = &pidWriter{w: c.Stdout, ready: make(chan struct{})}
+	if c.Stdout == nil {
+		c.pid.w = ioutil.Discard
+	}
+	return "echo $$ && exec " + c.args
 }
 
 func (c *Cmd) Start() error {
-	c.sess.Stdin = c.Stdin
-	c.sess.Stdout = c.Stdout
-	c.sess.Stderr = c.Stderr
-	return c.sess.Start(c.args)
+	return c.start(c.prepare())
 }
 
 func (c *Cmd) StartPTY(term string, h, w int, termmodes ssh.TerminalModes) error {
-	c.sess.Stdin = c.Stdin
-	c.sess.Stdout = c.Stdout
-	c.sess.Stderr = c.Stderr
+	args := c.prepare()
+
+	var modes []byte
+	for k, v := range termmodes {
+		kv := struct {
+			Key byte
+			Val uint32
+		}{k, v}
+		modes = append(modes, ssh.Marshal(&kv)...)
+	}
+	modes = append(modes, 0) // TTY_OP_END
+
+	ok, err := c.ch.SendRequest("pty-req", true, ssh.Marshal(&struct {
+		Term     string
+		Columns  uint32
+		Rows     uint32
+		Width    uint32
+		Height   uint32
+		Modelist string
+	}{term, uint32(w), uint32(h), uint32(w * 8), uint32(h * 8), string(modes)}))
+	if err == nil && !ok {
+		err = errors.New("ssh: pty-req failed")
+	}
+	if err != nil {
+		c.ch.Close()
+		return err
+	}
+	fmt.Println(args)
+	return c.start(args)
+}
 
-	if err := c.sess.RequestPty(term, h, w, termmodes); err != nil {
-		c.sess.Close()
+func (c *Cmd) start(args string) error {
+	ok, err := c.ch.SendRequest("exec", true, ssh.Marshal(&struct {
+		Command string
+	}{args}))
+	if err == nil && !ok {
+		err = errors.New("ssh: command failed to start")
+	}
+	if err != nil {
+		c.ch.Close()
 		return err
 	}
-	fmt.Println(c.args)
-	return c.sess.Start(c.args)
+
+	if !c.stdinPipe {
+		go func() {
+			if c.Stdin != nil {
+				io.Copy(c.ch, c.Stdin)
+			}
+			c.ch.CloseWrite()
+		}()
+	}
+	if !c.stdoutPipe {
+		var stdout io.Writer = ioutil.Discard
+		if c.pid != nil {
+			stdout = c.pid
+		} else if c.Stdout != nil {
+			stdout = c.Stdout
+		}
+		c.wg.Add(1)
+		go func() {
+			io.Copy(stdout, c.ch)
+			c.wg.Done()
+		}()
+	}
+	if !c.stderrPipe {
+		stderr := c.Stderr
+		if stderr == nil {
+			stderr = ioutil.Discard
+		}
+		c.wg.Add(1)
+		go func() {
+			io.Copy(stderr, c.ch.Stderr())
+			c.wg.Done()
+		}()
+	}
+
+	c.exit = make(chan struct{})
+	go c.handleRequests()
+	return nil
+}
+
+func (c *Cmd) handleRequests() {
+	for req := range c.reqs {
+		switch req.Type {
+		case "exit-status":
+			var msg struct {
+				Status uint32
+			}
+			if err := ssh.Unmarshal(req.Payload, &msg); err == nil {
+				c.status.status = int(msg.Status)
+				c.status.hasStatus = true
+			}
+		case "exit-signal":
+			var msg struct {
+				Signal     string
+				CoreDumped bool
+				Error      string
+				Lang       string
+			}
+			if err := ssh.Unmarshal(req.Payload, &msg); err == nil {
+				c.status.signal = msg.Signal
+				c.status.coreDumped = msg.CoreDumped
+				c.status.msg = msg.Error
+			}
+		}
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+	}
+	close(c.exit)
+}
+
+// Close closes the session channel, e.g. of a command that failed to start.
+func (c *Cmd) Close() error {
+	return c.ch.Close()
 }
 
 func (c *Cmd) Wait() error {
-	err := c.sess.Wait()
-	c.sess.Close()
-	return err
+	if c.exit == nil {
+		return errors.New("ssh: command not started")
+	}
+	<-c.exit
+	c.wg.Wait()
+	c.ch.Close()
+
+	st := c.status
+	switch {
+	case st.hasStatus && st.status == 0 && st.signal == "":
+		return nil
+	case st.hasStatus:
+		return &ExitError{
+			Status:     st.status,
+			Signal:     st.signal,
+			CoreDumped: st.coreDumped,
+			Msg:        st.msg,
+		}
+	case st.signal != "":
+		status := 128
+		if n, ok := SignalNumber(ssh.Signal(st.signal)); ok {
+			status += n
+		}
+		return &ExitError{
+			Status:     status,
+			Signal:     st.signal,
+			CoreDumped: st.coreDumped,
+			Msg:        st.msg,
+		}
+	}
+	return ErrExitMissing
 }
 
 func (c *Cmd) WindowChange(h, w int) error {
-	return c.sess.WindowChange(h, w)
+	_, err := c.ch.SendRequest("window-change", false, ssh.Marshal(&struct {
+		Columns uint32
+		Rows    uint32
+		Width   uint32
+		Height  uint32
+	}{uint32(w), uint32(h), uint32(w * 8), uint32(h * 8)}))
+	return err
+}
+
+func (c *Cmd) Signal(sig ssh.Signal) error {
+	_, err := c.ch.SendRequest("signal", false, ssh.Marshal(&struct {
+		Signal string
+	}{string(sig)}))
+	return err
+}
+
+// PID returns the remote process ID, or 0 if it is not known (yet).
+func (c *Cmd) PID() int {
+	if c.pid == nil {
+		return 0
+	}
+	return int(atomic.LoadInt32(&c.pid.pid))
+}
+
+// WaitPID waits until the remote process ID is known or the command exited
+// without reporting it and returns PID.
+func (c *Cmd) WaitPID() int {
+	if c.pid == nil || c.stdoutPipe || c.exit == nil {
+		return c.PID()
+	}
+	select {
+	case <-c.pid.ready:
+	case <-c.exit:
+	}
+	return c.PID()
 }
 
 func (c *Cmd) StdinPipe() (io.WriteCloser, error) {
-	return c.sess.StdinPipe()
+	if c.Stdin != nil {
+		return nil, errors.New("ssh: Stdin already set")
+	}
+	c.stdinPipe = true
+	return &channelWriter{c.ch}, nil
 }
 
 func (c *Cmd) StdoutPipe() (io.Reader, error) {
-	return c.sess.StdoutPipe()
+	if c.Stdout != nil {
+		return nil, errors.New("ssh: Stdout already set")
+	}
+	c.stdoutPipe = true
+	return c.ch, nil
 }
 
 func (c *Cmd) StderrPipe() (io.Reader, error) {
-	return c.sess.StderrPipe()
+	if c.Stderr != nil {
+		return nil, errors.New("ssh: Stderr already set")
+	}
+	c.stderrPipe = true
+	return c.ch.Stderr(), nil
 }
 
 func (c *Conn) RunCommandRaw(ctx context.Context, cmd string) (*Cmd, error) {
-	sess, err := c.sshc.NewSession()
+	ch, reqs, err := c.sshc.OpenChannel("session", nil)
 	if err != nil {
 		return nil, err
 	}
 
 	return &Cmd{
-		sess: sess,
+		ch:   ch,
+		reqs: reqs,
 		args: cmd,
 	}, nil
 }
@@ -82,3 +357,50 @@ func (c *Conn) RunCommand(ctx context.Context, name string, args ...string) (*Cm
 	}
 	return c.RunCommandRaw(ctx, b.String())
 }
+
+// channelWriter sends EOF instead of closing the channel on Close.
+type channelWriter struct {
+	ch ssh.Channel
+}
+
+func (w *channelWriter) Write(p []byte) (int, error) {
+	return w.ch.Write(p)
+}
+
+func (w *channelWriter) Close() error {
+	return w.ch.CloseWrite()
+}
+
+// pidWriter consumes the first line of output as PID.
+type pidWriter struct {
+	w     io.Writer
+	buf   []byte
+	done  bool
+	pid   int32
+	ready chan struct{}
+}
+
+func (p *pidWriter) Write(b []byte) (int, error) {
+	if p.done {
+		return p.w.Write(b)
+	}
+
+	p.buf = append(p.buf, b...)
+	i := bytes.IndexByte(p.buf, '\n')
+	if i < 0 {
+		return len(b), nil
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(p.buf[:i])))
+	atomic.StoreInt32(&p.pid, int32(pid))
+	p.done = true
+	close(p.ready)
+
+	rest := p.buf[i+1:]
+	p.buf = nil
+	if len(rest) > 0 {
+		if _, err := p.w.Write(rest); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
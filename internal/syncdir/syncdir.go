@@ -0,0 +1,357 @@
+// Package syncdir keeps a copy of a local directory tree on a remote host
+// up to date over SFTP. A manifest stored next to the copy records the
+// state of every file after the last transfer, so unchanged files are
+// recognized by size and modification time and touched files by their
+// content hash.
+package syncdir
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+)
+
+type Entry struct {
+	Size    int64
+	ModTime time.Time
+	SHA256  string
+	// target of symbolic links
+	Link string `json:",omitempty"`
+}
+
+// Manifest maps slash separated paths relative to the tree root to their
+// state.
+type Manifest map[string]Entry
+
+// Stats counts the work done by a sync.
+type Stats struct {
+	Uploaded   int
+	Downloaded int
+	Removed    int
+	Bytes      int64
+}
+
+// Tree is a local directory and its remote copy.
+type Tree struct {
+	Client *sftp.Client
+	Local  string
+	Remote string
+	// glob patterns matched against base names and relative paths
+	Exclude []string
+}
+
+func (t *Tree) manifestPath() string {
+	return t.Remote + ".manifest"
+}
+
+// LoadManifest reads the manifest of the remote copy, it is empty if there
+// is none yet.
+func (t *Tree) LoadManifest() (Manifest, error) {
+	m := Manifest{}
+	f, err := t.Client.Open(t.manifestPath())
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&m); err != nil {
+		// start over instead of failing forever
+		return Manifest{}, nil
+	}
+	return m, nil
+}
+
+func (t *Tree) SaveManifest(m Manifest) error {
+	tmp := t.manifestPath() + ".tmp"
+	f, err := t.Client.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(m); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := t.Client.PosixRename(tmp, t.manifestPath()); err != nil {
+		t.Client.Remove(t.manifestPath())
+		return t.Client.Rename(tmp, t.manifestPath())
+	}
+	return nil
+}
+
+func (t *Tree) excluded(rel string) bool {
+	for _, p := range t.Exclude {
+		if ok, _ := path.Match(p, path.Base(rel)); ok {
+			return true
+		}
+		if ok, _ := path.Match(p, rel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteState lists the files below the remote root.
+func (t *Tree) remoteState(root string) (map[string]os.FileInfo, error) {
+	state := make(map[string]os.FileInfo)
+	if _, err := t.Client.Lstat(root); os.IsNotExist(err) {
+		return state, nil
+	}
+	w := t.Client.Walk(root)
+	for w.Step() {
+		if err := w.Err(); err != nil {
+			return nil, err
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(w.Path(), t.Remote), "/")
+		if rel == "" {
+			continue
+		}
+		state[rel] = w.Stat()
+	}
+	return state, nil
+}
+
+// sameTime compares modification times at the one second resolution of
+// SFTP.
+func sameTime(a, b time.Time) bool {
+	return a.Unix() == b.Unix()
+}
+
+// Push updates the remote copy to match the local tree and returns the new
+// manifest. Remote files that are not in the manifest, like build outputs,
+// are left alone.
+func (t *Tree) Push(m Manifest) (Manifest, Stats, error) {
+	var stats Stats
+	if err := t.Client.MkdirAll(t.Remote); err != nil {
+		return nil, stats, errors.Wrapf(err, "cannot create %s", t.Remote)
+	}
+	remote, err := t.remoteState(t.Remote)
+	if err != nil {
+		return nil, stats, err
+	}
+
+	next := Manifest{}
+	err = filepath.Walk(t.Local, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(t.Local, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			return nil
+		}
+		if t.excluded(rel) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		dst := path.Join(t.Remote, rel)
+		r, rok := remote[rel]
+
+		switch {
+		case fi.IsDir():
+			if rok && !r.IsDir() {
+				t.Client.Remove(dst)
+				rok = false
+			}
+			if !rok {
+				if err := t.Client.Mkdir(dst); err != nil {
+					return errors.Wrapf(err, "cannot create %s", dst)
+				}
+			}
+			// the copy must stay writable for later syncs
+			return t.Client.Chmod(dst, fi.Mode().Perm()|0700)
+
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			e := Entry{Link: target}
+			next[rel] = e
+			if rok && r.Mode()&os.ModeSymlink != 0 && m[rel].Link == target {
+				return nil
+			}
+			if rok {
+				t.Client.Remove(dst)
+			}
+			return t.Client.Symlink(target, dst)
+
+		case fi.Mode().IsRegular():
+			e, ok := m[rel]
+			remoteOK := ok && rok && r.Mode().IsRegular() && r.Size() == e.Size && sameTime(r.ModTime(), e.ModTime)
+			if remoteOK && fi.Size() == e.Size && sameTime(fi.ModTime(), e.ModTime) {
+				next[rel] = e
+				return nil
+			}
+			sum, err := hashFile(p)
+			if err != nil {
+				return err
+			}
+			e = Entry{Size: fi.Size(), ModTime: fi.ModTime(), SHA256: sum}
+			if !remoteOK || m[rel].SHA256 != sum {
+				// replace instead of overwriting, the file may be read-only
+				if rok {
+					t.Client.Remove(dst)
+				}
+				if err := t.upload(p, dst); err != nil {
+					return err
+				}
+				stats.Uploaded++
+				stats.Bytes += fi.Size()
+			}
+			if err := t.Client.Chmod(dst, fi.Mode().Perm()); err != nil {
+				return err
+			}
+			if err := t.Client.Chtimes(dst, fi.ModTime(), fi.ModTime()); err != nil {
+				return err
+			}
+			next[rel] = e
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, stats, err
+	}
+
+	// files removed locally since the last sync
+	for rel := range m {
+		if _, ok := next[rel]; ok {
+			continue
+		}
+		if r, ok := remote[rel]; ok && !r.IsDir() {
+			if err := t.Client.Remove(path.Join(t.Remote, rel)); err == nil {
+				stats.Removed++
+			}
+		}
+	}
+	return next, stats, nil
+}
+
+func (t *Tree) upload(src, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rf, err := t.Client.Create(dst)
+	if err != nil {
+		return errors.Wrapf(err, "cannot create %s", dst)
+	}
+	if _, err := io.Copy(rf, f); err != nil {
+		rf.Close()
+		return errors.Wrapf(err, "cannot upload %s", src)
+	}
+	return rf.Close()
+}
+
+// Pull copies the given paths, relative to the tree root, from the remote
+// copy to the local tree and records them in m. Files that did not change
+// are skipped, nothing is deleted locally.
+func (t *Tree) Pull(m Manifest, paths []string) (Stats, error) {
+	var stats Stats
+	for _, p := range paths {
+		p = path.Clean(filepath.ToSlash(p))
+		if path.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../") {
+			return stats, errors.Errorf("output %s is outside of the working directory", p)
+		}
+		root := path.Join(t.Remote, p)
+		state, err := t.remoteState(root)
+		if err != nil {
+			return stats, err
+		}
+		if fi, err := t.Client.Lstat(root); err == nil && !fi.IsDir() {
+			state[p] = fi
+		}
+
+		for rel, r := range state {
+			if t.excluded(rel) {
+				continue
+			}
+			local := filepath.Join(t.Local, filepath.FromSlash(rel))
+			switch {
+			case r.IsDir():
+				if err := os.MkdirAll(local, r.Mode().Perm()|0700); err != nil {
+					return stats, err
+				}
+			case r.Mode().IsRegular():
+				if fi, err := os.Stat(local); err == nil && fi.Size() == r.Size() && sameTime(fi.ModTime(), r.ModTime()) {
+					continue
+				}
+				sum, err := t.download(path.Join(t.Remote, rel), local, r)
+				if err != nil {
+					return stats, err
+				}
+				// local mtime is set from the remote one
+				m[rel] = Entry{Size: r.Size(), ModTime: r.ModTime(), SHA256: sum}
+				stats.Downloaded++
+				stats.Bytes += r.Size()
+			}
+		}
+	}
+	return stats, nil
+}
+
+func (t *Tree) download(src, dst string, fi os.FileInfo) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", err
+	}
+	rf, err := t.Client.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer rf.Close()
+
+	tmp := dst + ".rexec-sync"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm()|0600)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), rf); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return "", errors.Wrapf(err, "cannot download %s", src)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	os.Chmod(dst, fi.Mode().Perm())
+	os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hashFile(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,296 @@
+package syncdir
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// newTree returns a tree syncing a temporary local directory to another
+// one through an in-process SFTP server, and a function removing both.
+func newTree(t *testing.T) (*Tree, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "syncdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, s1 := io.Pipe()
+	s2, c2 := io.Pipe()
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{s2, s1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	client, err := sftp.NewClientPipe(c1, c2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup := func() {
+		s1.Close()
+		c2.Close()
+		client.Close()
+		filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+			if err == nil && fi.IsDir() {
+				os.Chmod(p, 0700)
+			}
+			return nil
+		})
+		os.RemoveAll(dir)
+	}
+
+	local := filepath.Join(dir, "local")
+	if err := os.Mkdir(local, 0755); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return &Tree{
+		Client:  client,
+		Local:   local,
+		Remote:  filepath.Join(dir, "remote"),
+		Exclude: []string{"*.o", "build/tmp"},
+	}, cleanup
+}
+
+// modify writes p with a modification time n seconds from now, syncs only
+// tell files apart at one second resolution.
+func modify(t *testing.T, p, data string, n int) {
+	t.Helper()
+	writeFile(t, p, data)
+	at := time.Now().Add(time.Duration(n) * time.Second)
+	if err := os.Chtimes(p, at, at); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeFile(t *testing.T, p, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, p string) string {
+	t.Helper()
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return "<" + err.Error() + ">"
+	}
+	return string(b)
+}
+
+func keys(m Manifest) []string {
+	var ret []string
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func TestExcluded(t *testing.T) {
+	tree := &Tree{Exclude: []string{"*.o", ".git", "build/tmp"}}
+	tests := []struct {
+		rel  string
+		want bool
+	}{
+		{"a.o", true},
+		{"src/a.o", true},
+		{"a.go", false},
+		{".git", true},
+		{"sub/.git", true},
+		{"build/tmp", true},
+		{"build/tmp2", false},
+		{"x/build/tmp", false},
+	}
+	for _, tt := range tests {
+		if got := tree.excluded(tt.rel); got != tt.want {
+			t.Errorf("excluded(%q) = %v, want %v", tt.rel, got, tt.want)
+		}
+	}
+}
+
+func TestPush(t *testing.T) {
+	tree, cleanup := newTree(t)
+	defer cleanup()
+	l := func(p string) string { return filepath.Join(tree.Local, p) }
+	r := func(p string) string { return filepath.Join(tree.Remote, p) }
+	writeFile(t, l("a.txt"), "a")
+	writeFile(t, l("src/b.go"), "b")
+	writeFile(t, l("src/b.o"), "object")
+	writeFile(t, l("build/tmp/x"), "x")
+	if err := os.Symlink("a.txt", l("link")); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := tree.LoadManifest()
+	if err != nil || len(m) != 0 {
+		t.Fatalf("LoadManifest without copy = %v, %v", m, err)
+	}
+
+	type step struct {
+		name     string
+		change   func()
+		uploaded int
+		removed  int
+	}
+	steps := []step{
+		{"initial", func() {}, 2, 0},
+		{"unchanged", func() {}, 0, 0},
+		{"touched", func() { modify(t, l("a.txt"), "a", 10) }, 0, 0},
+		{"modified", func() { modify(t, l("a.txt"), "changed", 20) }, 1, 0},
+		{"read-only dir", func() {
+			os.Chmod(l("src"), 0555)
+		}, 0, 0},
+		{"file in read-only dir", func() {
+			os.Chmod(l("src"), 0755)
+			writeFile(t, l("src/c.go"), "c")
+			os.Chmod(l("src"), 0555)
+		}, 1, 0},
+		{"read-only file", func() {
+			os.Chmod(l("src"), 0755)
+			modify(t, l("src/c.go"), "c2", 30)
+			os.Chmod(l("src/c.go"), 0444)
+		}, 1, 0},
+		{"read-only file modified", func() {
+			os.Chmod(l("src/c.go"), 0644)
+			modify(t, l("src/c.go"), "c3", 40)
+			os.Chmod(l("src/c.go"), 0444)
+		}, 1, 0},
+		{"removed", func() {
+			os.Remove(l("a.txt"))
+			os.Chmod(l("src"), 0555)
+		}, 0, 1},
+	}
+	for _, s := range steps {
+		s.change()
+		next, stats, err := tree.Push(m)
+		if err != nil {
+			t.Fatalf("%s: Push: %v", s.name, err)
+		}
+		if stats.Uploaded != s.uploaded || stats.Removed != s.removed {
+			t.Errorf("%s: uploaded %d, removed %d; want %d, %d", s.name, stats.Uploaded, stats.Removed, s.uploaded, s.removed)
+		}
+		if err := tree.SaveManifest(next); err != nil {
+			t.Fatal(err)
+		}
+		if m, err = tree.LoadManifest(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got, want := keys(m), []string{"link", "src/b.go", "src/c.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("manifest = %q, want %q", got, want)
+	}
+	if got := readFile(t, r("src/c.go")); got != "c3" {
+		t.Errorf("remote src/c.go = %q", got)
+	}
+	if _, err := os.Lstat(r("src/b.o")); !os.IsNotExist(err) {
+		t.Errorf("excluded file copied: %v", err)
+	}
+	if _, err := os.Lstat(r("build/tmp")); !os.IsNotExist(err) {
+		t.Errorf("excluded directory copied: %v", err)
+	}
+	if target, err := os.Readlink(r("link")); err != nil || target != "a.txt" {
+		t.Errorf("remote link = %q, %v", target, err)
+	}
+	if fi, err := os.Stat(r("src")); err != nil || fi.Mode().Perm()&0700 != 0700 {
+		t.Errorf("remote src mode = %v, %v", fi.Mode(), err)
+	}
+}
+
+func TestPushKeepsRemoteOutputs(t *testing.T) {
+	tree, cleanup := newTree(t)
+	defer cleanup()
+	writeFile(t, filepath.Join(tree.Local, "a"), "a")
+	m, _, err := tree.Push(Manifest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(tree.Remote, "out/result"), "result")
+	if _, _, err := tree.Push(m); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(tree.Remote, "out/result")); got != "result" {
+		t.Errorf("remote output = %q", got)
+	}
+}
+
+func TestLoadManifestCorrupt(t *testing.T) {
+	tree, cleanup := newTree(t)
+	defer cleanup()
+	writeFile(t, tree.Remote+".manifest", "{not json")
+	m, err := tree.LoadManifest()
+	if err != nil || len(m) != 0 {
+		t.Errorf("LoadManifest = %v, %v; want empty", m, err)
+	}
+}
+
+func TestPull(t *testing.T) {
+	tree, cleanup := newTree(t)
+	defer cleanup()
+	writeFile(t, filepath.Join(tree.Local, "src/a.go"), "a")
+	m, _, err := tree.Push(Manifest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(tree.Remote, "out/bin"), "bin")
+	writeFile(t, filepath.Join(tree.Remote, "out/sub/lib"), "lib")
+	writeFile(t, filepath.Join(tree.Remote, "out/skip.o"), "o")
+	writeFile(t, filepath.Join(tree.Remote, "report.txt"), "report")
+	writeFile(t, filepath.Join(tree.Remote, "other"), "other")
+
+	tests := []struct {
+		name       string
+		paths      []string
+		downloaded int
+		err        bool
+	}{
+		{"directory", []string{"out"}, 2, false},
+		{"again unchanged", []string{"out"}, 0, false},
+		{"single file", []string{"./report.txt"}, 1, false},
+		{"missing", []string{"nothing"}, 0, false},
+		{"absolute", []string{"/etc"}, 0, true},
+		{"parent", []string{"../x"}, 0, true},
+		{"parent after clean", []string{"out/../../x"}, 0, true},
+	}
+	for _, tt := range tests {
+		stats, err := tree.Pull(m, tt.paths)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: Pull error = %v, want error %v", tt.name, err, tt.err)
+		}
+		if stats.Downloaded != tt.downloaded {
+			t.Errorf("%s: downloaded %d, want %d", tt.name, stats.Downloaded, tt.downloaded)
+		}
+	}
+
+	for p, want := range map[string]string{
+		"out/bin":     "bin",
+		"out/sub/lib": "lib",
+		"report.txt":  "report",
+	} {
+		if got := readFile(t, filepath.Join(tree.Local, p)); got != want {
+			t.Errorf("local %s = %q, want %q", p, got, want)
+		}
+		if _, ok := m[p]; !ok {
+			t.Errorf("%s not recorded in manifest", p)
+		}
+	}
+	for _, p := range []string{"out/skip.o", "other"} {
+		if _, err := os.Stat(filepath.Join(tree.Local, p)); !os.IsNotExist(err) {
+			t.Errorf("%s pulled: %v", p, err)
+		}
+	}
+}
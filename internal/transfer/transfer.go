@@ -0,0 +1,16 @@
+// Package transfer holds what both ends of a file copy need to agree on.
+package transfer
+
+import (
+	"fmt"
+	"path"
+	"time"
+)
+
+// PartialPath is where an incomplete copy of a file with the given size and
+// modification time is kept next to dst. A later copy of the same file
+// resumes from it, a changed source starts over.
+func PartialPath(dst string, size int64, mtime time.Time) string {
+	dir, base := path.Split(dst)
+	return path.Join(dir, fmt.Sprintf(".%s.%d-%d.rexec-part", base, size, mtime.Unix()))
+}